@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Permission is what a user may do with a note, every level includes the
+// ones below it.
+type Permission int
+
+const (
+	PermNone Permission = iota
+	PermRead
+	PermWrite
+	PermOwner
+)
+
+func (perm Permission) String() string {
+	switch perm {
+	case PermRead:
+		return "read"
+	case PermWrite:
+		return "write"
+	case PermOwner:
+		return "owner"
+	default:
+		return "none"
+	}
+}
+
+func ParsePermission(name string) (Permission, error) {
+	switch name {
+	case "read", "r":
+		return PermRead, nil
+	case "write", "rw", "w":
+		return PermWrite, nil
+	default:
+		return PermNone, fmt.Errorf("unknown permission \"%s\", use read or write", name)
+	}
+}
+
+// Scope is the set of notes, notebooks and tags a request works with:
+// the personal ones of a user or the ones of a workspace. All listings and
+// lookups by name go through it instead of filtering by user_id.
+type Scope struct {
+	UserId      int
+	WorkspaceId *int
+}
+
+// Scope returns the scope of the active workspace of the session.
+func (user *User) Scope() Scope {
+	return Scope{UserId: user.Id, WorkspaceId: user.Workspace.IdPtr()}
+}
+
+// NoteScope returns the scope the note belongs to.
+func NoteScope(note *Note) Scope {
+	return Scope{UserId: note.UserId, WorkspaceId: note.WorkspaceId}
+}
+
+// Where returns the condition selecting rows of the scope from a table
+// with user_id and workspace_id columns, prefix is the table alias with a
+// dot or empty.
+func (scope Scope) Where(prefix string) (string, []interface{}) {
+	if scope.WorkspaceId != nil {
+		return prefix + "workspace_id=?", []interface{}{*scope.WorkspaceId}
+	}
+
+	return prefix + "user_id=? and " + prefix + "workspace_id is null", []interface{}{scope.UserId}
+}
+
+func (scope Scope) Equal(other Scope) bool {
+	if scope.WorkspaceId != nil || other.WorkspaceId != nil {
+		return scope.WorkspaceId != nil && other.WorkspaceId != nil && *scope.WorkspaceId == *other.WorkspaceId
+	}
+
+	return scope.UserId == other.UserId
+}
+
+// ScopePermission returns what the user may do in the active scope, like
+// creating notes and notebooks. The role is read every time so that
+// changes of membership apply to open sessions.
+func (user *User) ScopePermission(db sqlx.Queryer) (Permission, error) {
+	if user.Workspace == nil {
+		return PermOwner, nil
+	}
+
+	return user.workspacePermission(db, user.Workspace.Id)
+}
+
+// CheckWorkspace switches the session back to the personal notes when the
+// user can no longer read the active workspace. It is called for every
+// request, so members who were removed stop seeing its notes at once.
+func (user *User) CheckWorkspace(db sqlx.Queryer) error {
+	if user.Workspace == nil {
+		return nil
+	}
+
+	has, err := user.ScopePermission(db)
+	if err != nil {
+		return err
+	}
+
+	if has < PermRead {
+		name := user.Workspace.Name
+		user.Workspace = nil
+		return fmt.Errorf("you are no longer a member of workspace \"%s\", switched to your personal notes", name)
+	}
+
+	return nil
+}
+
+func (user *User) RequireScopePermission(db sqlx.Queryer, perm Permission) error {
+	has, err := user.ScopePermission(db)
+	if err != nil {
+		return err
+	}
+
+	if has < perm {
+		return fmt.Errorf("you need %s permission in workspace \"%s\"", perm, user.Workspace.Name)
+	}
+
+	return nil
+}
+
+func (user *User) workspacePermission(db sqlx.Queryer, workspace_id int) (Permission, error) {
+	var role string
+
+	err := sqlx.Get(db, &role, "select role from workspace_members where workspace_id=? and user_id=?",
+		workspace_id, user.Id)
+	if err == sql.ErrNoRows {
+		return PermNone, nil
+	}
+	if err != nil {
+		return PermNone, err
+	}
+
+	return RolePermission(role), nil
+}
+
+// NotePermission returns what the user may do with the note: as its owner,
+// by their role in the workspace of the note or through a share of the
+// note or of a notebook containing it. Editors of a workspace own the notes
+// they created there.
+func (user *User) NotePermission(db sqlx.Queryer, note *Note) (Permission, error) {
+	has := PermNone
+
+	if note.WorkspaceId != nil {
+		perm, err := user.workspacePermission(db, *note.WorkspaceId)
+		if err != nil {
+			return PermNone, err
+		}
+
+		if perm == PermWrite && note.UserId == user.Id {
+			perm = PermOwner
+		}
+		has = perm
+	} else if note.UserId == user.Id {
+		has = PermOwner
+	}
+
+	if has == PermOwner {
+		return has, nil
+	}
+
+	var perm sql.NullInt64
+	err := sqlx.Get(db, &perm, `with recursive chain(id, parent_id) as (
+			select id, parent_id from notebooks where id=?
+			union all
+			select nb.id, nb.parent_id from notebooks nb join chain c on nb.id=c.parent_id
+		)
+		select max(case permission when 'write' then ? else ? end) from shares
+		where user_id=? and (note_id=? or notebook_id in (select id from chain))`,
+		note.NotebookId, int(PermWrite), int(PermRead), user.Id, note.Id)
+	if err != nil {
+		return PermNone, err
+	}
+
+	if Permission(perm.Int64) > has {
+		has = Permission(perm.Int64)
+	}
+
+	return has, nil
+}
+
+// GetNoteWithPermission returns the note if the user has at least perm on
+// it. Notes the user can't read are reported as not found.
+func (user *User) GetNoteWithPermission(db DB, note_id int, perm Permission) (*Note, error) {
+	var note Note
+
+	err := db.Get(&note, "select * from notes where id=$1 and deleted_at is null", note_id)
+	if err != nil {
+		return nil, fmt.Errorf("note with id %d not found", note_id)
+	}
+
+	has, err := user.NotePermission(db, &note)
+	if err != nil {
+		return nil, err
+	}
+
+	if has < PermRead {
+		return nil, fmt.Errorf("note with id %d not found", note_id)
+	}
+
+	if has < perm {
+		return nil, fmt.Errorf("you need %s permission on note %d", perm, note_id)
+	}
+
+	notes := []Note{note}
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	return &notes[0], nil
+}
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Titles, items and names encrypted by the server start with this prefix,
+// the rest is the base64 of the nonce followed by the sealed text.
+const atRestPrefix = "enc:v1:"
+
+// Blobs encrypted by the server start with this prefix followed by the
+// nonce and the sealed data.
+const blobPrefix = "encb:v1:"
+
+// MasterKeyEnv holds the base64 master key, it takes precedence over the
+// master_key_file of the config.
+const MasterKeyEnv = "GOKEEPER_MASTER_KEY"
+
+// AtRest encrypts titles and queries of notes in the database. Every user
+// has a data key of their own which is stored in the users table wrapped
+// with the master key, so changing the master key doesn't require
+// re-encrypting all notes at once.
+//
+// Queries and attachments are kept in the blob store and encrypted with a
+// key of their own shared by all users. Their nonce is derived from the
+// content, so equal content is encrypted the same way and stored once, at
+// the cost of revealing which blobs are equal.
+type AtRest struct {
+	master cipher.AEAD
+	KeyId  string
+
+	mu   sync.Mutex
+	keys map[int]cipher.AEAD
+
+	blob      cipher.AEAD
+	blobNonce []byte
+}
+
+// atRest is the encryption of the server, nil when no master key is set.
+var atRest *AtRest
+
+// ReadMasterKey returns the master key from the environment or from file,
+// nil when neither is set.
+func ReadMasterKey(file string) ([]byte, error) {
+	encoded := os.Getenv(MasterKeyEnv)
+	if encoded == "" && file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+
+	if encoded == "" {
+		return nil, nil
+	}
+
+	return ParseMasterKey(encoded)
+}
+
+func ParseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != chacha20poly1305.KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes encoded in base64", chacha20poly1305.KeySize)
+	}
+
+	return key, nil
+}
+
+// GenerateMasterKey writes a new random master key to file.
+func GenerateMasterKey(file string) error {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	return err
+}
+
+func NewAtRest(master_key []byte) (*AtRest, error) {
+	master, err := chacha20poly1305.NewX(master_key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the id tells which master key wrapped a data key without revealing it
+	sum := sha256.Sum256(master_key)
+
+	return &AtRest{master: master, KeyId: hex.EncodeToString(sum[:8]), keys: make(map[int]cipher.AEAD)}, nil
+}
+
+func seal(aead cipher.AEAD, plain, additional []byte) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, additional)), nil
+}
+
+func open(aead cipher.AEAD, text string, additional []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrong encrypted text")
+	}
+
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// a data key is bound to its user so it can't be moved to another one
+func userAdditional(user_id int) []byte {
+	return []byte("user:" + strconv.Itoa(user_id))
+}
+
+func (a *AtRest) wrap(user_id int, key []byte) (string, error) {
+	return seal(a.master, key, userAdditional(user_id))
+}
+
+func (a *AtRest) unwrap(user_id int, wrapped string) (cipher.AEAD, error) {
+	key, err := open(a.master, wrapped, userAdditional(user_id))
+	if err != nil {
+		return nil, fmt.Errorf("data key of user %d can't be unwrapped", user_id)
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+// newDataKey returns a new data key with its wrapped form.
+func (a *AtRest) newDataKey(user_id int) (cipher.AEAD, string, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", err
+	}
+
+	wrapped, err := a.wrap(user_id, key)
+	if err != nil {
+		return nil, "", err
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	return aead, wrapped, err
+}
+
+// userKey returns the data key of the user, a user without one gets it
+// here.
+func (a *AtRest) userKey(db sqlx.Ext, user_id int) (cipher.AEAD, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if aead, ok := a.keys[user_id]; ok {
+		return aead, nil
+	}
+
+	var user User
+	if err := sqlx.Get(db, &user, "select * from users where id=?", user_id); err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	var err error
+
+	switch {
+	case user.DataKey == "":
+		var wrapped string
+		if aead, wrapped, err = a.newDataKey(user_id); err != nil {
+			return nil, err
+		}
+
+		_, err = db.Exec("update users set data_key=?, key_id=? where id=?", wrapped, a.KeyId, user_id)
+	case user.KeyId != a.KeyId:
+		err = fmt.Errorf("data key of user %d is wrapped with another master key, finish the key rotation", user_id)
+	default:
+		aead, err = a.unwrap(user_id, user.DataKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a.keys[user_id] = aead
+	return aead, nil
+}
+
+// SealText encrypts text with the data key of the user, without a master
+// key text is returned as it is.
+func (a *AtRest) SealText(db sqlx.Ext, user_id int, text string) (string, error) {
+	if a == nil {
+		return text, nil
+	}
+
+	aead, err := a.userKey(db, user_id)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(aead, []byte(text), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return atRestPrefix + sealed, nil
+}
+
+// OpenText decrypts text sealed for the user, text stored before
+// encryption was turned on is returned as it is.
+func (a *AtRest) OpenText(db sqlx.Ext, user_id int, text string) (string, error) {
+	if a == nil || !strings.HasPrefix(text, atRestPrefix) {
+		return text, nil
+	}
+
+	aead, err := a.userKey(db, user_id)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := open(aead, text[len(atRestPrefix):], nil)
+	if err != nil {
+		return "", fmt.Errorf("note of user %d can't be decrypted", user_id)
+	}
+
+	return string(plain), nil
+}
+
+// blobAdditional binds the key of the blob store to its use.
+var blobAdditional = []byte("blobs")
+
+// blobKey returns the key of the blob store. CheckAtRestKeys creates it
+// when the server starts and RotateMasterKey before a rotation, so it is
+// never created in a transaction which may be rolled back.
+func (a *AtRest) blobKey(db sqlx.Ext) (cipher.AEAD, []byte, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.blob != nil {
+		return a.blob, a.blobNonce, nil
+	}
+
+	var stored struct {
+		DataKey string `db:"data_key"`
+		KeyId   string `db:"key_id"`
+	}
+	err := sqlx.Get(db, &stored, "select data_key, key_id from blob_key where id=1")
+
+	var key []byte
+	switch {
+	case err == sql.ErrNoRows:
+		key = make([]byte, chacha20poly1305.KeySize)
+		if _, err = rand.Read(key); err != nil {
+			return nil, nil, err
+		}
+
+		var wrapped string
+		if wrapped, err = seal(a.master, key, blobAdditional); err != nil {
+			return nil, nil, err
+		}
+
+		_, err = db.Exec("insert into blob_key (id, data_key, key_id) values (1, ?, ?)", wrapped, a.KeyId)
+	case err != nil:
+	case stored.KeyId != a.KeyId:
+		err = fmt.Errorf("key of the blob store is wrapped with another master key, finish the key rotation")
+	default:
+		if key, err = open(a.master, stored.DataKey, blobAdditional); err != nil {
+			err = fmt.Errorf("key of the blob store can't be unwrapped")
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.blob, err = chacha20poly1305.NewX(key); err != nil {
+		return nil, nil, err
+	}
+
+	nonce := hmac.New(sha256.New, key)
+	nonce.Write([]byte("nonce"))
+	a.blobNonce = nonce.Sum(nil)
+
+	return a.blob, a.blobNonce, nil
+}
+
+// SealBlob encrypts data for the blob store, without a master key data is
+// returned as it is.
+func (a *AtRest) SealBlob(db sqlx.Ext, data []byte) ([]byte, error) {
+	if a == nil {
+		return data, nil
+	}
+
+	aead, nonce_key, err := a.blobKey(db)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, nonce_key)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := append([]byte(blobPrefix), nonce...)
+	return aead.Seal(sealed, nonce, data, nil), nil
+}
+
+// OpenBlob decrypts data read from the blob store for the user it belongs
+// to. Blobs stored before encryption was turned on are returned as they
+// are and ones stored before the blob store had a key of its own are
+// sealed with the data key of the user.
+func (a *AtRest) OpenBlob(db sqlx.Ext, user_id int, data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, []byte(atRestPrefix)) {
+		text, err := a.OpenText(db, user_id, string(data))
+		return []byte(text), err
+	}
+
+	if a == nil || !bytes.HasPrefix(data, []byte(blobPrefix)) {
+		return data, nil
+	}
+
+	aead, _, err := a.blobKey(db)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := data[len(blobPrefix):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("blob of user %d can't be decrypted", user_id)
+	}
+
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("blob of user %d can't be decrypted", user_id)
+	}
+
+	return plain, nil
+}
+
+// SealNote encrypts the title of note with the data key of its owner and
+// its query for the blob store before it is written, without a master key
+// it does nothing.
+func SealNote(db sqlx.Ext, note *Note) error {
+	if atRest == nil {
+		return nil
+	}
+
+	var err error
+	if note.Title, err = atRest.SealText(db, note.UserId, note.Title); err != nil {
+		return err
+	}
+
+	data, err := atRest.SealBlob(db, []byte(note.Data))
+	note.Data = string(data)
+	return err
+}
+
+// PrepareDataKeys creates the missing data keys of users before their notes
+// are sealed in a transaction, a key created in one which is rolled back
+// would stay cached although it was never stored.
+func PrepareDataKeys(db *sqlx.DB, user_ids ...int) error {
+	if atRest == nil {
+		return nil
+	}
+
+	for _, user_id := range user_ids {
+		if _, err := atRest.userKey(db, user_id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PrepareNoteKeys creates the missing data keys of the owners of notes,
+// see PrepareDataKeys.
+func PrepareNoteKeys(db *sqlx.DB, note_ids ...int) error {
+	if atRest == nil || len(note_ids) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("select distinct user_id from notes where id in (?)", note_ids)
+	if err != nil {
+		return err
+	}
+
+	user_ids := make([]int, 0)
+	if err = db.Select(&user_ids, db.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	return PrepareDataKeys(db, user_ids...)
+}
+
+// OpenNotes reads the queries of notes read from the database from the
+// blob store and decrypts them and the titles.
+func OpenNotes(db sqlx.Ext, notes []Note) error {
+	bodies, err := noteBodies(db, notes)
+	if err != nil {
+		return err
+	}
+
+	for i := range notes {
+		if notes[i].BodyBlob != nil {
+			data, ok := bodies[*notes[i].BodyBlob]
+			if !ok {
+				return fmt.Errorf("blob %s of note %d is missing", *notes[i].BodyBlob, notes[i].Id)
+			}
+
+			if data, err = atRest.OpenBlob(db, notes[i].UserId, data); err != nil {
+				return err
+			}
+			notes[i].Data = string(data)
+		} else if notes[i].Data, err = atRest.OpenText(db, notes[i].UserId, notes[i].Data); err != nil {
+			return err
+		}
+
+		if notes[i].Title, err = atRest.OpenText(db, notes[i].UserId, notes[i].Title); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// EncryptedAtRest reports whether the text of notes can't be searched by
+// SQL and has to be matched after decryption.
+func EncryptedAtRest() bool {
+	return atRest != nil
+}
+
+// CheckAtRestKeys makes sure the server starts with the master key the
+// database was encrypted with.
+func CheckAtRestKeys(db *sqlx.DB) error {
+	var key_ids []string
+	err := db.Select(&key_ids, "select distinct key_id from users where data_key<>'' union select key_id from blob_key")
+	if err != nil {
+		return err
+	}
+
+	if atRest == nil {
+		if len(key_ids) > 0 {
+			return fmt.Errorf("notes are encrypted, set the master key in the config or %s", MasterKeyEnv)
+		}
+		return nil
+	}
+
+	for _, key_id := range key_ids {
+		if key_id != atRest.KeyId {
+			return fmt.Errorf("data keys are wrapped with master key %s, finish the key rotation", key_id)
+		}
+	}
+
+	var count int
+	if err := db.Get(&count, "select count(*) from users where next_data_key<>''"); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("key rotation of %d users was interrupted, finish it", count)
+	}
+
+	if _, _, err := atRest.blobKey(db); err != nil {
+		return err
+	}
+
+	err = db.Get(&count, "select count(*) from notes n where n.title not like ? or "+unsealedBlob("n.body_blob"),
+		atRestPrefix+"%")
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.Printf("%d notes are not encrypted with the current keys yet, run the key rotation to encrypt them\n", count)
+	}
+
+	return nil
+}
+
+// unsealedBlob is the SQL condition of the blob of column not being
+// encrypted with the key of the blob store.
+func unsealedBlob(column string) string {
+	return "exists (select 1 from blobs b where b.hash=" + column + " and cast(substr(b.data, 1, " +
+		strconv.Itoa(len(blobPrefix)) + ") as text)<>'" + blobPrefix + "')"
+}
+
+// RotateMasterKey gives every user a new data key wrapped with the new
+// master key and re-encrypts their titles, links, items and attachment
+// names with it. The key of the blob store is wrapped with the new master
+// key and blobs which are not encrypted with it yet are. Old is the
+// current master key, nil if the notes are not encrypted yet. Texts are
+// re-encrypted in transactions of batch rows and the new data key only
+// replaces the old one when all of them are done, so an interrupted
+// rotation is finished by running it again with the same keys.
+func RotateMasterKey(db *sqlx.DB, old, new *AtRest, batch int) error {
+	if err := rotateBlobKey(db, old, new); err != nil {
+		return err
+	}
+
+	var users []User
+	err := db.Select(&users, `select * from users u where key_id<>?1 or data_key='' or next_data_key<>'' or exists
+		(select 1 from notes n where n.user_id=u.id and (n.title not like ?2 or `+unsealedBlob("n.body_blob")+`)) or exists
+		(select 1 from attachment_chunks c join attachments a on a.id=c.attachment_id join notes n on n.id=a.note_id
+		where n.user_id=u.id and `+unsealedBlob("c.blob")+`) order by id`, new.KeyId, atRestPrefix+"%")
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		n, err := rotateUserKey(db, user, old, new, batch)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("user %d: %d notes re-encrypted\n", user.Id, n)
+	}
+
+	// blobs of the old chunks and pages freed by the update still hold the
+	// old text
+	if _, _, err = CollectGarbage(db); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("vacuum")
+	return err
+}
+
+// rotateBlobKey wraps the key of the blob store with the new master key,
+// a new key is created when there is none yet. The key itself stays the
+// same so blobs are not re-encrypted.
+func rotateBlobKey(db *sqlx.DB, old, new *AtRest) error {
+	var stored struct {
+		DataKey string `db:"data_key"`
+		KeyId   string `db:"key_id"`
+	}
+	err := db.Get(&stored, "select data_key, key_id from blob_key where id=1")
+
+	var key []byte
+	switch {
+	case err == sql.ErrNoRows:
+		_, _, err = new.blobKey(db)
+		return err
+	case err != nil:
+		return err
+	case stored.KeyId == new.KeyId:
+		return nil
+	case old != nil && stored.KeyId == old.KeyId:
+		if key, err = open(old.master, stored.DataKey, blobAdditional); err != nil {
+			return fmt.Errorf("key of the blob store can't be unwrapped")
+		}
+	default:
+		return fmt.Errorf("key of the blob store is wrapped with unknown master key %s", stored.KeyId)
+	}
+
+	wrapped, err := seal(new.master, key, blobAdditional)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("update blob_key set data_key=?, key_id=? where id=1", wrapped, new.KeyId)
+	return err
+}
+
+// rotationKey returns the data key the user is rotated to. It is stored
+// wrapped with the new master key before anything is encrypted with it,
+// so a rotation which was interrupted goes on with the same key.
+func rotationKey(db *sqlx.DB, user User, new *AtRest) (cipher.AEAD, error) {
+	if user.NextDataKey != "" {
+		return new.unwrap(user.Id, user.NextDataKey)
+	}
+
+	to, wrapped, err := new.newDataKey(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = db.Exec("update users set next_data_key=? where id=?", wrapped, user.Id); err != nil {
+		return nil, err
+	}
+
+	return to, nil
+}
+
+// rotateBatches calls fn for the ids query selects, it takes the user id,
+// the last id done and the number of ids. Every batch of ids is done in a
+// transaction of its own.
+func rotateBatches(db *sqlx.DB, batch int, query string, user_id int, fn func(tx *sqlx.Tx, id int) error) error {
+	for last := 0; ; {
+		ids := make([]int, 0, batch)
+		if err := db.Select(&ids, query, user_id, last, batch); err != nil {
+			return err
+		}
+
+		if len(ids) == 0 {
+			return nil
+		}
+
+		tx := db.MustBegin()
+		for _, id := range ids {
+			if err := fn(tx, id); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		last = ids[len(ids)-1]
+	}
+}
+
+func rotateUserKey(db *sqlx.DB, user User, old, new *AtRest, batch int) (int, error) {
+	var from cipher.AEAD
+	var err error
+
+	switch {
+	case user.DataKey == "":
+	case user.KeyId == new.KeyId:
+		from, err = new.unwrap(user.Id, user.DataKey)
+	case old != nil && user.KeyId == old.KeyId:
+		from, err = old.unwrap(user.Id, user.DataKey)
+	default:
+		err = fmt.Errorf("data key of user %d is wrapped with unknown master key %s", user.Id, user.KeyId)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	to, err := rotationKey(db, user, new)
+	if err != nil {
+		return 0, err
+	}
+
+	// done reports whether text was re-encrypted before the rotation was
+	// interrupted
+	done := func(text string) bool {
+		if !strings.HasPrefix(text, atRestPrefix) {
+			return false
+		}
+
+		_, err := open(to, text[len(atRestPrefix):], nil)
+		return err == nil
+	}
+
+	reencrypt := func(text string) (string, error) {
+		if done(text) {
+			return text, nil
+		}
+
+		if strings.HasPrefix(text, atRestPrefix) {
+			if from == nil {
+				return "", fmt.Errorf("note of user %d is encrypted but the user has no data key", user.Id)
+			}
+
+			plain, err := open(from, text[len(atRestPrefix):], nil)
+			if err != nil {
+				return "", fmt.Errorf("note of user %d can't be decrypted", user.Id)
+			}
+			text = string(plain)
+		}
+
+		sealed, err := seal(to, []byte(text), nil)
+		return atRestPrefix + sealed, err
+	}
+
+	// toBlob encrypts the blob of hash with the key of the blob store and
+	// returns the hash of the encrypted one
+	toBlob := func(tx *sqlx.Tx, hash *string) (*string, error) {
+		if hash == nil {
+			return nil, nil
+		}
+
+		data, err := GetBlob(tx, *hash)
+		if err != nil || bytes.HasPrefix(data, []byte(blobPrefix)) {
+			return hash, err
+		}
+
+		if bytes.HasPrefix(data, []byte(atRestPrefix)) {
+			if from == nil {
+				return nil, fmt.Errorf("blob of user %d is encrypted but the user has no data key", user.Id)
+			}
+
+			if data, err = open(from, string(data[len(atRestPrefix):]), nil); err != nil {
+				return nil, fmt.Errorf("blob of user %d can't be decrypted", user.Id)
+			}
+		}
+
+		if data, err = new.SealBlob(tx, data); err != nil {
+			return nil, err
+		}
+
+		sealed, err := PutBlob(tx, data)
+		if err != nil {
+			return nil, err
+		}
+
+		return &sealed, ReleaseBlob(tx, *hash)
+	}
+
+	count := 0
+	err = rotateBatches(db, batch, "select id from notes where user_id=? and id>? order by id limit ?", user.Id,
+		func(tx *sqlx.Tx, id int) error {
+			note := Note{}
+			if err := tx.Get(&note, "select * from notes where id=?", id); err != nil {
+				return err
+			}
+
+			var err error
+			if note.Title, err = reencrypt(note.Title); err != nil {
+				return err
+			}
+
+			if note.BodyBlob, err = toBlob(tx, note.BodyBlob); err != nil {
+				return err
+			}
+
+			count++
+			_, err = tx.NamedExec("update notes set title=:title, body_blob=:body_blob where id=:id", note)
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	err = rotateBatches(db, batch, `select l.id from note_links l join notes n on n.id=l.note_id
+		where n.user_id=? and l.id>? order by l.id limit ?`, user.Id,
+		func(tx *sqlx.Tx, id int) error {
+			link := NoteLink{}
+			if err := tx.Get(&link, "select * from note_links where id=?", id); err != nil {
+				return err
+			}
+
+			var err error
+			if link.Target, err = reencrypt(link.Target); err != nil {
+				return err
+			}
+
+			_, err = tx.NamedExec("update note_links set target=:target where id=:id", link)
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	err = rotateBatches(db, batch, `select i.id from checklist_items i join notes n on n.id=i.note_id
+		where n.user_id=? and i.id>? order by i.id limit ?`, user.Id,
+		func(tx *sqlx.Tx, id int) error {
+			item := ChecklistItem{}
+			if err := tx.Get(&item, "select * from checklist_items where id=?", id); err != nil {
+				return err
+			}
+
+			var err error
+			if item.Text, err = reencrypt(item.Text); err != nil {
+				return err
+			}
+
+			_, err = tx.NamedExec("update checklist_items set text=:text where id=:id", item)
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	err = rotateBatches(db, batch, `select a.id from attachments a join notes n on n.id=a.note_id
+		where n.user_id=? and a.id>? order by a.id limit ?`, user.Id,
+		func(tx *sqlx.Tx, id int) error {
+			attachment := Attachment{}
+			if err := tx.Get(&attachment, "select * from attachments where id=?", id); err != nil {
+				return err
+			}
+
+			var err error
+			if attachment.Name, err = reencrypt(attachment.Name); err != nil {
+				return err
+			}
+
+			_, err = tx.NamedExec("update attachments set name=:name where id=:id", attachment)
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	// chunks are read one at a time to keep large attachments out of
+	// memory, the encrypted ones are new blobs
+	err = rotateBatches(db, batch, `select c.rowid from attachment_chunks c join attachments a on a.id=c.attachment_id
+		join notes n on n.id=a.note_id where n.user_id=? and c.rowid>? order by c.rowid limit ?`, user.Id,
+		func(tx *sqlx.Tx, rowid int) error {
+			var hash *string
+			if err := tx.Get(&hash, "select blob from attachment_chunks where rowid=?", rowid); err != nil {
+				return err
+			}
+
+			hash, err := toBlob(tx, hash)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("update attachment_chunks set blob=? where rowid=?", hash, rowid)
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = db.Exec("update users set data_key=next_data_key, key_id=?, next_data_key='' where id=?", new.KeyId, user.Id)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// AttachmentChunkSize is the largest piece of an attachment sent in one
+// message.
+const AttachmentChunkSize = 64 * 1024
+
+// DefaultMaxAttachmentSize is used when max_attachment_size is not set.
+const DefaultMaxAttachmentSize = 10 * 1024 * 1024
+
+// maxAttachmentSize is the largest attachment the server accepts.
+var maxAttachmentSize int64 = DefaultMaxAttachmentSize
+
+// Attachment is a file kept with a note. Its content is stored in chunks
+// of at most AttachmentChunkSize, Encrypted is set when the client
+// encrypted them end-to-end.
+type Attachment struct {
+	Id        int       `db:"id" json:"id"`
+	NoteId    int       `db:"note_id" json:"note_id"`
+	Name      string    `db:"name" json:"name"`
+	Size      int64     `db:"size" json:"size"`
+	Chunks    int       `db:"chunks" json:"chunks"`
+	Sha256    string    `db:"sha256" json:"sha256"`
+	Encrypted bool      `db:"encrypted" json:"encrypted"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// Upload is an attachment being received, it is kept in the session until
+// all chunks are there and written at once.
+type Upload struct {
+	Attachment
+	chunks   [][]byte
+	received int64
+}
+
+func checkAttachmentName(name string) error {
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "/\\\x00") || name == "." || name == ".." {
+		return fmt.Errorf("wrong attachment name \"%s\"", name)
+	}
+
+	return nil
+}
+
+// StartUpload begins receiving an attachment of a note the user may write,
+// an upload which was not finished is dropped.
+func (user *User) StartUpload(db *sqlx.DB, attachment Attachment) error {
+	user.Upload = nil
+
+	note, err := user.GetNoteWithPermission(db, attachment.NoteId, PermWrite)
+	if err != nil {
+		return err
+	}
+
+	// encrypted names can't be checked by the server
+	if !IsEncrypted(attachment.Name) {
+		if err := checkAttachmentName(attachment.Name); err != nil {
+			return err
+		}
+	}
+
+	if attachment.Size < 0 || attachment.Size > maxAttachmentSize {
+		return fmt.Errorf("attachment is larger than %d bytes", maxAttachmentSize)
+	}
+
+	owner := User{Id: note.UserId}
+	if err = owner.CheckQuota(db, 0, attachment.Size); err != nil {
+		return err
+	}
+
+	user.Upload = &Upload{Attachment: attachment}
+	return nil
+}
+
+// AddChunk adds the next chunk of the upload of the session.
+func (user *User) AddChunk(seq int, data []byte) error {
+	upload := user.Upload
+	if upload == nil {
+		return fmt.Errorf("no attachment is being uploaded")
+	}
+
+	if seq != len(upload.chunks) {
+		user.Upload = nil
+		return fmt.Errorf("chunk %d was expected, upload is canceled", len(upload.chunks))
+	}
+
+	if len(data) == 0 || len(data) > AttachmentChunkSize || upload.received+int64(len(data)) > upload.Size {
+		user.Upload = nil
+		return fmt.Errorf("wrong chunk size, upload is canceled")
+	}
+
+	upload.chunks = append(upload.chunks, data)
+	upload.received += int64(len(data))
+	return nil
+}
+
+// FinishUpload checks that the upload of the session is complete and has
+// the checksum sha256 and stores it, the note and the quota are checked
+// again as they may have changed meanwhile.
+func (user *User) FinishUpload(db *sqlx.DB, sha256_sum string) (*Attachment, error) {
+	upload := user.Upload
+	user.Upload = nil
+
+	if upload == nil {
+		return nil, fmt.Errorf("no attachment is being uploaded")
+	}
+
+	if upload.received != upload.Size {
+		return nil, fmt.Errorf("attachment is incomplete, %d of %d bytes received", upload.received, upload.Size)
+	}
+
+	hash := sha256.New()
+	for _, chunk := range upload.chunks {
+		hash.Write(chunk)
+	}
+
+	upload.Sha256 = hex.EncodeToString(hash.Sum(nil))
+	if upload.Sha256 != sha256_sum {
+		return nil, fmt.Errorf("attachment was damaged in transfer, checksums differ")
+	}
+
+	note, err := user.GetNoteWithPermission(db, upload.NoteId, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	attachment := upload.Attachment
+	attachment.Chunks = len(upload.chunks)
+
+	sealed := attachment
+	if atRest != nil {
+		if sealed.Name, err = atRest.SealText(db, note.UserId, sealed.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	chunks := make([][]byte, len(upload.chunks))
+	for i, chunk := range upload.chunks {
+		if chunks[i], err = atRest.SealBlob(db, chunk); err != nil {
+			return nil, err
+		}
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	// uploads started on other connections may have used up the quota
+	owner := User{Id: note.UserId}
+	if err = owner.CheckQuota(tx, 0, attachment.Size); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.NamedExec(`insert into attachments (note_id, name, size, chunks, sha256, encrypted, created_at)
+		values (:note_id, :name, :size, :chunks, :sha256, :encrypted, CURRENT_TIMESTAMP)`, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	attachment.Id = int(id)
+
+	for i, chunk := range chunks {
+		hash, err := PutBlob(tx, chunk)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec("insert into attachment_chunks (attachment_id, seq, blob) values (?, ?, ?)", id, i, hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &attachment, tx.Commit()
+}
+
+// GetAttachment returns an attachment of a note the user has at least perm
+// on together with the note.
+func (user *User) GetAttachment(db *sqlx.DB, attachment_id int, perm Permission) (*Attachment, *Note, error) {
+	attachment := new(Attachment)
+	if err := db.Get(attachment, "select * from attachments where id=?", attachment_id); err != nil {
+		return nil, nil, fmt.Errorf("attachment with id %d not found", attachment_id)
+	}
+
+	note, err := user.GetNoteWithPermission(db, attachment.NoteId, PermRead)
+	if err != nil {
+		return nil, nil, fmt.Errorf("attachment with id %d not found", attachment_id)
+	}
+
+	if perm > PermRead {
+		if _, err = user.GetNoteWithPermission(db, attachment.NoteId, perm); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if attachment.Name, err = atRest.OpenText(db, note.UserId, attachment.Name); err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, note, nil
+}
+
+func (user *User) GetAttachments(db *sqlx.DB, note_id int) ([]Attachment, error) {
+	note, err := user.GetNoteById(db, note_id)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := make([]Attachment, 0)
+	if err = db.Select(&attachments, "select * from attachments where note_id=? order by id", note.Id); err != nil {
+		return nil, err
+	}
+
+	for i := range attachments {
+		if attachments[i].Name, err = atRest.OpenText(db, note.UserId, attachments[i].Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return attachments, nil
+}
+
+// GetAttachmentChunk returns chunk seq of an attachment the user can read
+// with the attachment, an empty attachment has an empty chunk 0.
+func (user *User) GetAttachmentChunk(db *sqlx.DB, attachment_id, seq int) (*Attachment, []byte, error) {
+	attachment, note, err := user.GetAttachment(db, attachment_id, PermRead)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if seq == 0 && attachment.Chunks == 0 {
+		return attachment, nil, nil
+	}
+
+	var hash string
+	err = db.Get(&hash, "select blob from attachment_chunks where attachment_id=? and seq=?", attachment_id, seq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("attachment %d has no chunk %d", attachment_id, seq)
+	}
+
+	data, err := GetBlob(db, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if data, err = atRest.OpenBlob(db, note.UserId, data); err != nil {
+		return nil, nil, err
+	}
+
+	return attachment, data, nil
+}
+
+func (user *User) DeleteAttachment(db *sqlx.DB, attachment_id int) error {
+	if _, _, err := user.GetAttachment(db, attachment_id, PermWrite); err != nil {
+		return err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := releaseChunkBlobs(tx, "?", attachment_id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("delete from attachment_chunks where attachment_id=?", attachment_id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("delete from attachments where id=?", attachment_id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func TestParallelUploadsQuota(t *testing.T) {
+	db, users := openTestDB(t, "alice")
+	alice := users["alice"]
+
+	saved := quotas
+	quotas = Quotas{MaxBytes: 3000}
+	defer func() { quotas = saved }()
+
+	note := &Note{Title: "t", Data: "select 1", Kind: NotePlain}
+	if err := note.CreateNote(db, alice); err != nil {
+		t.Fatal(err)
+	}
+
+	// two sessions of the same user pass the check when they start
+	data := make([]byte, 2000)
+	sum := sha256.Sum256(data)
+
+	sessions := []*User{{Id: alice.Id}, {Id: alice.Id}}
+	for _, session := range sessions {
+		if err := session.StartUpload(db, Attachment{NoteId: note.Id, Name: "a.bin", Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := session.AddChunk(0, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sessions[0].FinishUpload(db, hex.EncodeToString(sum[:])); err != nil {
+		t.Fatalf("first upload failed: %s", err)
+	}
+
+	if _, err := sessions[1].FinishUpload(db, hex.EncodeToString(sum[:])); err == nil {
+		t.Errorf("second upload exceeded the quota")
+	}
+
+	usage, err := alice.GetUsage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.Attachments != 1 || usage.Bytes > quotas.MaxBytes {
+		t.Errorf("usage is %d attachments and %d bytes, want 1 attachment within %d bytes",
+			usage.Attachments, usage.Bytes, quotas.MaxBytes)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PutBlob stores data unless a blob with the same content exists and
+// takes a reference to it. Blobs are keyed by the SHA-256 of what is
+// stored, so equal content is stored once, for all users. Content
+// encrypted at rest by the server is sealed the same way for everyone,
+// see AtRest, content encrypted by clients is not shared.
+func PutBlob(tx *sqlx.Tx, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	_, err := tx.Exec(`insert into blobs (hash, size, data, refs) values (?, ?, ?, 1)
+		on conflict (hash) do update set refs=refs+1`, hash, len(data), data)
+	if err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+func GetBlob(db sqlx.Queryer, hash string) ([]byte, error) {
+	var data []byte
+	if err := sqlx.Get(db, &data, "select data from blobs where hash=?", hash); err != nil {
+		return nil, fmt.Errorf("blob %s is missing", hash)
+	}
+
+	return data, nil
+}
+
+// ReleaseBlob drops a reference to a blob, blobs nobody uses are only
+// removed by CollectGarbage.
+func ReleaseBlob(tx *sqlx.Tx, hash string) error {
+	_, err := tx.Exec("update blobs set refs=refs-1 where hash=?", hash)
+	return err
+}
+
+// noteBody is the SQL expression of the query of a note, notes written
+// before the blob store existed keep it in data_text until it is moved.
+func noteBody(prefix string) string {
+	return "ifnull((select cast(b.data as text) from blobs b where b.hash=" + prefix + "body_blob), " +
+		prefix + "data_text)"
+}
+
+// noteBodySize is the SQL expression of the size of the query of a note,
+// a shared query counts for every note it is in.
+func noteBodySize(prefix string) string {
+	return "ifnull((select b.size from blobs b where b.hash=" + prefix + "body_blob), length(cast(" +
+		prefix + "data_text as blob)))"
+}
+
+// putNoteBody stores the query of note in the blob store, note is left
+// with the hash of the blob and an empty query to write to the notes
+// table.
+func putNoteBody(tx *sqlx.Tx, note *Note) error {
+	hash, err := PutBlob(tx, []byte(note.Data))
+	if err != nil {
+		return err
+	}
+
+	note.BodyBlob, note.Data = &hash, ""
+	return nil
+}
+
+// releaseNoteBody drops the reference of note to its query.
+func releaseNoteBody(tx *sqlx.Tx, note *Note) error {
+	if note.BodyBlob == nil {
+		return nil
+	}
+
+	return ReleaseBlob(tx, *note.BodyBlob)
+}
+
+// releaseBodyBlobs drops the references of the notes selected by the
+// query of note ids to their queries.
+func releaseBodyBlobs(tx *sqlx.Tx, notes string, args ...interface{}) error {
+	_, err := tx.Exec(`update blobs set refs=refs-(select count(*) from notes n
+		where n.body_blob=blobs.hash and n.id in (`+notes+`))
+		where hash in (select body_blob from notes where id in (`+notes+`))`,
+		append(args, args...)...)
+	return err
+}
+
+// noteBodies returns the blobs of the queries of notes by their hashes.
+func noteBodies(db sqlx.Queryer, notes []Note) (map[string][]byte, error) {
+	hashes := make([]string, 0, len(notes))
+	for i := range notes {
+		if notes[i].BodyBlob != nil {
+			hashes = append(hashes, *notes[i].BodyBlob)
+		}
+	}
+
+	bodies := make(map[string][]byte, len(hashes))
+	if len(hashes) == 0 {
+		return bodies, nil
+	}
+
+	query, args, err := sqlx.In("select hash, data from blobs where hash in (?)", hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		var data []byte
+		if err = rows.Scan(&hash, &data); err != nil {
+			return nil, err
+		}
+		bodies[hash] = data
+	}
+
+	return bodies, rows.Err()
+}
+
+// releaseChunkBlobs drops the references of the chunks of the attachments
+// selected by the query of attachment ids, a blob may be used by several
+// chunks of them.
+func releaseChunkBlobs(tx *sqlx.Tx, attachments string, args ...interface{}) error {
+	_, err := tx.Exec(`update blobs set refs=refs-(select count(*) from attachment_chunks c
+		where c.blob=blobs.hash and c.attachment_id in (`+attachments+`))
+		where hash in (select blob from attachment_chunks where attachment_id in (`+attachments+`))`,
+		append(args, args...)...)
+	return err
+}
+
+// moveChunksToBlobs stores chunks of attachments uploaded before the blob
+// store existed in it.
+func moveChunksToBlobs(db *sqlx.DB) error {
+	type chunk struct {
+		AttachmentId int    `db:"attachment_id"`
+		Seq          int    `db:"seq"`
+		Data         []byte `db:"data"`
+	}
+
+	for {
+		chunks := make([]chunk, 0)
+		err := db.Select(&chunks, "select attachment_id, seq, data from attachment_chunks where data is not null limit 100")
+		if err != nil || len(chunks) == 0 {
+			return err
+		}
+
+		tx := db.MustBegin()
+		for _, c := range chunks {
+			hash, err := PutBlob(tx, c.Data)
+			if err == nil {
+				_, err = tx.Exec("update attachment_chunks set blob=?, data=null where attachment_id=? and seq=?",
+					hash, c.AttachmentId, c.Seq)
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// moveBodiesToBlobs stores queries of notes written before the blob store
+// existed in it. Queries encrypted at rest are moved as they are, the key
+// rotation encrypts them for the blob store.
+func moveBodiesToBlobs(db *sqlx.DB) error {
+	for {
+		notes := make([]Note, 0)
+		err := db.Select(&notes, "select id, data_text from notes where body_blob is null limit 100")
+		if err != nil || len(notes) == 0 {
+			return err
+		}
+
+		tx := db.MustBegin()
+		for i := range notes {
+			err := putNoteBody(tx, &notes[i])
+			if err == nil {
+				_, err = tx.NamedExec("update notes set body_blob=:body_blob, data_text=:data_text where id=:id", notes[i])
+			}
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// CollectGarbage recounts the references of all blobs, removes the ones
+// nobody uses and returns how many were removed and their size. The file
+// only shrinks after a vacuum.
+func CollectGarbage(db *sqlx.DB) (int, int64, error) {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec(`update blobs set refs=(select count(*) from attachment_chunks c where c.blob=blobs.hash)+
+		(select count(*) from notes n where n.body_blob=blobs.hash)`)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var stats struct {
+		Count int   `db:"count"`
+		Size  int64 `db:"size"`
+	}
+	if err = tx.Get(&stats, "select count(*) as count, ifnull(sum(size), 0) as size from blobs where refs<=0"); err != nil {
+		return 0, 0, err
+	}
+
+	if _, err = tx.Exec("delete from blobs where refs<=0"); err != nil {
+		return 0, 0, err
+	}
+
+	return stats.Count, stats.Size, tx.Commit()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// MaxBulkOps is the largest number of operations in a bulk request.
+const MaxBulkOps = 1000
+
+// BulkOp is an operation of a bulk request. create, update and delete take
+// Note like their single requests, tag and untag take the id of Note and
+// Tags.
+type BulkOp struct {
+	Op   string   `json:"op"`
+	Note Note     `json:"note"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// BulkResult is the result of the operation at the same index, NoteId is
+// the note it created or changed. Conflict is the current note when an
+// update or delete was based on another version.
+type BulkResult struct {
+	NoteId   int    `json:"note_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Conflict *Note  `json:"conflict,omitempty"`
+}
+
+// runBulkOp runs op within tx and returns the id of its note.
+func (user *User) runBulkOp(tx *sqlx.Tx, op BulkOp) (int, error) {
+	var err error
+
+	switch op.Op {
+	case "create":
+		if err = CheckNoteSize(&op.Note); err == nil {
+			err = op.Note.createNote(tx, user)
+		}
+	case "update":
+		if err = CheckNoteSize(&op.Note); err == nil {
+			err = user.editNote(tx, op.Note)
+		}
+	case "delete":
+		err = user.deleteNote(tx, op.Note)
+	case "tag":
+		err = user.tagNote(tx, op.Note.Id, op.Tags)
+	case "untag":
+		err = user.untagNote(tx, op.Note.Id, op.Tags)
+	default:
+		err = fmt.Errorf("unknown operation \"%s\", use create, update, delete, tag or untag", op.Op)
+	}
+
+	return op.Note.Id, err
+}
+
+// RunBulk runs ops in one transaction which is only committed when all of
+// them succeed, otherwise nothing is changed. Every operation is run, so
+// the results tell all that failed, and the changes of one which failed
+// are undone before the next one runs.
+func (user *User) RunBulk(db *sqlx.DB, ops []BulkOp) ([]BulkResult, bool, error) {
+	if len(ops) == 0 {
+		return nil, false, fmt.Errorf("bulk request has no operations")
+	}
+
+	if len(ops) > MaxBulkOps {
+		return nil, false, fmt.Errorf("bulk request has %d operations, at most %d are allowed", len(ops), MaxBulkOps)
+	}
+
+	note_ids := make([]int, 0, len(ops))
+	for _, op := range ops {
+		if op.Op == "update" {
+			note_ids = append(note_ids, op.Note.Id)
+		}
+	}
+
+	if err := PrepareDataKeys(db, user.Id); err != nil {
+		return nil, false, err
+	}
+
+	if err := PrepareNoteKeys(db, note_ids...); err != nil {
+		return nil, false, err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	results := make([]BulkResult, len(ops))
+	failed := false
+	for i, op := range ops {
+		if _, err := tx.Exec("savepoint bulk_op"); err != nil {
+			return nil, false, err
+		}
+
+		note_id, err := user.runBulkOp(tx, op)
+		if err == nil {
+			results[i].NoteId = note_id
+			if _, err = tx.Exec("release bulk_op"); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		failed = true
+		results[i].Error = err.Error()
+
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			results[i].Conflict = &conflict.Current
+		}
+
+		if _, err = tx.Exec("rollback to bulk_op"); err != nil {
+			return nil, false, err
+		}
+		if _, err = tx.Exec("release bulk_op"); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if failed {
+		return results, false, nil
+	}
+
+	return results, true, tx.Commit()
+}
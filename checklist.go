@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ChecklistItem is an item of a checklist note. Items are stored apart
+// from the query so they can be changed one at a time, Position counts
+// from 1.
+type ChecklistItem struct {
+	Id       int    `db:"id" json:"id"`
+	NoteId   int    `db:"note_id" json:"note_id"`
+	Position int    `db:"position" json:"position"`
+	Text     string `db:"text" json:"text"`
+	Checked  bool   `db:"checked" json:"checked"`
+}
+
+// ChecklistProgress returns how many of items are checked and how many
+// there are.
+func ChecklistProgress(items []ChecklistItem) (int, int) {
+	done := 0
+	for _, item := range items {
+		if item.Checked {
+			done++
+		}
+	}
+
+	return done, len(items)
+}
+
+func checkItemText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return fmt.Errorf("item text is empty")
+	}
+
+	return nil
+}
+
+// checkChecklistSize refuses to make a checklist with the items it has
+// and items with texts larger than the max_note_size of the server, note
+// holds the title and query it is stored with.
+func checkChecklistSize(tx *sqlx.Tx, note *Note, texts []string) error {
+	if quotas.MaxNoteSize <= 0 {
+		return nil
+	}
+
+	checklist := []Note{{Id: note.Id, UserId: note.UserId, Title: note.Title, Data: note.Data, Kind: NoteChecklist}}
+	if err := LoadChecklistItems(tx, checklist); err != nil {
+		return err
+	}
+
+	for _, text := range texts {
+		checklist[0].Items = append(checklist[0].Items, ChecklistItem{Text: text})
+	}
+
+	return CheckNoteSize(&checklist[0])
+}
+
+// LoadChecklistItems fills in the items of checklist notes.
+func LoadChecklistItems(db sqlx.Ext, notes []Note) error {
+	index := make(map[int]int)
+	ids := make([]int, 0)
+	for i := range notes {
+		if notes[i].Kind == NoteChecklist {
+			index[notes[i].Id] = i
+			ids = append(ids, notes[i].Id)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	query, args, err := sqlx.In("select * from checklist_items where note_id in (?) order by note_id, position", ids)
+	if err != nil {
+		return err
+	}
+
+	items := make([]ChecklistItem, 0)
+	if err = sqlx.Select(db, &items, db.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		note := &notes[index[item.NoteId]]
+		if item.Text, err = atRest.OpenText(db, note.UserId, item.Text); err != nil {
+			return err
+		}
+		note.Items = append(note.Items, item)
+	}
+
+	return nil
+}
+
+// addChecklistItems appends items with texts to the end of a checklist.
+func addChecklistItems(tx *sqlx.Tx, note *Note, texts []string) error {
+	var last int
+	if err := tx.Get(&last, "select ifnull(max(position), 0) from checklist_items where note_id=?", note.Id); err != nil {
+		return err
+	}
+
+	if err := checkChecklistSize(tx, note, texts); err != nil {
+		return err
+	}
+
+	for i, text := range texts {
+		if err := checkItemText(text); err != nil {
+			return err
+		}
+
+		sealed, err := atRest.SealText(tx, note.UserId, text)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("insert into checklist_items (note_id, position, text, checked) values (?, ?, ?, 0)",
+			note.Id, last+i+1, sealed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// touchNote marks a note as changed after its items changed.
+func touchNote(tx *sqlx.Tx, note_id int) error {
+	_, err := tx.Exec("update notes set updated_at=CURRENT_TIMESTAMP, version=version+1 where id=?", note_id)
+	return err
+}
+
+// checklistNote returns a checklist note the user may write.
+func (user *User) checklistNote(db *sqlx.DB, note_id int) (*Note, error) {
+	note, err := user.GetNoteWithPermission(db, note_id, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	if note.Kind != NoteChecklist {
+		return nil, fmt.Errorf("note %d is not a checklist", note_id)
+	}
+
+	return note, nil
+}
+
+// checklistItem returns an item of a checklist the user may write with
+// its note.
+func (user *User) checklistItem(db *sqlx.DB, item_id int) (*ChecklistItem, *Note, error) {
+	item := new(ChecklistItem)
+	if err := db.Get(item, "select * from checklist_items where id=?", item_id); err != nil {
+		return nil, nil, fmt.Errorf("item with id %d not found", item_id)
+	}
+
+	note, err := user.checklistNote(db, item.NoteId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return item, note, nil
+}
+
+// GetChecklistItems returns the items of a checklist note the user can
+// read.
+func (user *User) GetChecklistItems(db *sqlx.DB, note_id int) ([]ChecklistItem, error) {
+	note, err := user.GetNoteById(db, note_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if note.Items == nil {
+		return []ChecklistItem{}, nil
+	}
+
+	return note.Items, nil
+}
+
+// AddChecklistItem adds an unchecked item at the end of a checklist.
+func (user *User) AddChecklistItem(db *sqlx.DB, note_id int, text string) (int, error) {
+	note, err := user.checklistNote(db, note_id)
+	if err != nil {
+		return 0, err
+	}
+
+	owner := User{Id: note.UserId}
+	if err = owner.CheckQuota(db, 0, int64(len(text))); err != nil {
+		return 0, err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err = addChecklistItems(tx, note, []string{text}); err != nil {
+		return 0, err
+	}
+
+	if err = touchNote(tx, note.Id); err != nil {
+		return 0, err
+	}
+
+	return note.Id, tx.Commit()
+}
+
+// Item operations return the id of the checklist they changed.
+
+// CheckChecklistItem checks or unchecks an item.
+func (user *User) CheckChecklistItem(db *sqlx.DB, item_id int, checked bool) (int, error) {
+	item, note, err := user.checklistItem(db, item_id)
+	if err != nil {
+		return 0, err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("update checklist_items set checked=? where id=?", checked, item.Id); err != nil {
+		return 0, err
+	}
+
+	if err = touchNote(tx, note.Id); err != nil {
+		return 0, err
+	}
+
+	return note.Id, tx.Commit()
+}
+
+// MoveChecklistItem moves an item to position, positions past the end move
+// it to the end.
+func (user *User) MoveChecklistItem(db *sqlx.DB, item_id, position int) (int, error) {
+	item, note, err := user.checklistItem(db, item_id)
+	if err != nil {
+		return 0, err
+	}
+
+	if position < 1 {
+		return 0, fmt.Errorf("positions start at 1")
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	ids, err := otherItemIds(tx, item)
+	if err != nil {
+		return 0, err
+	}
+
+	if position > len(ids)+1 {
+		position = len(ids) + 1
+	}
+	ids = append(ids[:position-1], append([]int{item.Id}, ids[position-1:]...)...)
+
+	if err = renumberItems(tx, ids); err != nil {
+		return 0, err
+	}
+
+	if err = touchNote(tx, note.Id); err != nil {
+		return 0, err
+	}
+
+	return note.Id, tx.Commit()
+}
+
+// RemoveChecklistItem deletes an item, the items after it move up.
+func (user *User) RemoveChecklistItem(db *sqlx.DB, item_id int) (int, error) {
+	item, note, err := user.checklistItem(db, item_id)
+	if err != nil {
+		return 0, err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	ids, err := otherItemIds(tx, item)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = tx.Exec("delete from checklist_items where id=?", item.Id); err != nil {
+		return 0, err
+	}
+
+	if err = renumberItems(tx, ids); err != nil {
+		return 0, err
+	}
+
+	if err = touchNote(tx, note.Id); err != nil {
+		return 0, err
+	}
+
+	return note.Id, tx.Commit()
+}
+
+// otherItemIds returns the ids of the items of the checklist of item
+// except item in their order. They are read in the transaction which
+// renumbers them, so items changed in the meantime are not lost.
+func otherItemIds(tx *sqlx.Tx, item *ChecklistItem) ([]int, error) {
+	ids := make([]int, 0)
+	err := tx.Select(&ids, "select id from checklist_items where note_id=? and id<>? order by position",
+		item.NoteId, item.Id)
+	return ids, err
+}
+
+// renumberItems gives items the positions of their ids in ids.
+func renumberItems(tx *sqlx.Tx, ids []int) error {
+	for i, id := range ids {
+		if _, err := tx.Exec("update checklist_items set position=? where id=?", i+1, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
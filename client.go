@@ -1,16 +1,24 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
 func (user User) ConnectToServer(host, port string, Type int) (net.Conn, error) {
-	connection, err := net.Dial("tcp", host+":"+port)
+	conn, err := net.Dial("tcp", host+":"+port)
 	if err != nil {
 		return nil, err
 	}
+	connection := NewMessageConn(conn)
 
 	user_data, err := json.Marshal(user)
 	if err != nil {
@@ -38,6 +46,7 @@ func (user User) ConnectToServer(host, port string, Type int) (net.Conn, error)
 	}
 
 	if msg.MessageTypeStatus == SuccessT {
+		connection.Dispatch()
 		return connection, nil
 	} else if msg.MessageTypeStatus == ErrorT {
 		err_data := ErrorMessageData{}
@@ -53,6 +62,11 @@ func (user User) ConnectToServer(host, port string, Type int) (net.Conn, error)
 }
 
 func CreateNote(connection net.Conn, note Note) error {
+	title := note.Title
+	if err := noteCipher.EncryptNote(&note); err != nil {
+		return err
+	}
+
 	note_data, err := json.Marshal(note)
 	if err != nil {
 		return err
@@ -86,7 +100,7 @@ func CreateNote(connection net.Conn, note Note) error {
 			return err
 		}
 
-		return fmt.Errorf(err_msg.ErrorText)
+		return fmt.Errorf(strings.ReplaceAll(err_msg.ErrorText, note.Title, title))
 	default:
 		return fmt.Errorf("unknown server message code")
 	}
@@ -120,6 +134,7 @@ func GetNote(connection net.Conn, note Note) (*Note, error) {
 		if err = json.Unmarshal(msg.Data, &_note); err != nil {
 			return nil, err
 		}
+		noteCipher.DecryptNote(&_note)
 
 		return &_note, nil
 	case ErrorT:
@@ -135,49 +150,132 @@ func GetNote(connection net.Conn, note Note) (*Note, error) {
 }
 
 func UpdateNote(connection net.Conn, note Note) error {
-	note_data, err := json.Marshal(note)
-	if err != nil {
+	title := note.Title
+	if err := noteCipher.EncryptNote(&note); err != nil {
 		return err
 	}
 
-	msg := MessageData{MessageTypeStatus: UpdateNoteT, Data: note_data}
+	err := decryptConflict(Request(connection, UpdateNoteT, note, nil))
+	if err != nil && title != note.Title && !errors.As(err, new(*ConflictError)) {
+		// errors about the title name the encrypted one
+		return fmt.Errorf(strings.ReplaceAll(err.Error(), note.Title, title))
+	}
+
+	return err
+}
+
+func DeleteNote(connection net.Conn, note Note) error {
+	return decryptConflict(Request(connection, DeleteNoteT, note, nil))
+}
+
+// decryptConflict decrypts the current note carried by a conflict error.
+func decryptConflict(err error) error {
+	var conflict *ConflictError
+	if errors.As(err, &conflict) {
+		noteCipher.DecryptNote(&conflict.Current)
+	}
+
+	return err
+}
+
+func GetAllNotes(connection net.Conn) ([]Note, error) {
+	msg := MessageData{MessageTypeStatus: GetAllMyNotesT}
 	msg_data, err := json.Marshal(msg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if _, err = connection.Write(msg_data); err != nil {
-		return err
+		return nil, err
 	}
 
 	bytes, err := GetMessageData(connection)
+	if err != nil {
+		return nil, err
+	}
 
 	if err = json.Unmarshal(bytes, &msg); err != nil {
-		return err
+		return nil, err
 	}
 
 	switch msg.MessageTypeStatus {
 	case SuccessT:
-		return nil
+		note_slice := NoteSliceData{}
+		if err = json.Unmarshal(msg.Data, &note_slice); err != nil {
+			return nil, err
+		}
+
+		notes := make([]Note, 0, note_slice.Count)
+		notes = append(notes, note_slice.Notes...)
+		noteCipher.DecryptNotes(notes)
+
+		return notes, nil
 	case ErrorT:
 		err_msg := ErrorMessageData{}
 		if err = json.Unmarshal(msg.Data, &err_msg); err != nil {
-			return err
+			return nil, err
 		}
 
-		return fmt.Errorf(err_msg.ErrorText)
+		return nil, fmt.Errorf(err_msg.ErrorText)
 	default:
-		return fmt.Errorf("unknown server message code")
+		return nil, fmt.Errorf("unknown server message code")
 	}
 }
 
-func DeleteNote(connection net.Conn, note Note) error {
-	note_data, err := json.Marshal(note)
-	if err != nil {
-		return err
+// ListNotes returns the notes of the current scope sorted and projected by
+// opts, titles encrypted end-to-end are sorted once they are decrypted.
+func ListNotes(connection net.Conn, opts ListOptions) ([]Note, error) {
+	note_slice := NoteSliceData{}
+	if err := Request(connection, GetAllMyNotesT, opts, &note_slice); err != nil {
+		return nil, err
+	}
+	noteCipher.DecryptNotes(note_slice.Notes)
+
+	if noteCipher.Active() {
+		SortNotes(note_slice.Notes, opts)
+	}
+
+	return note_slice.Notes, nil
+}
+
+// GetAllNotesByTitle returns the notes with titles containing the title
+// of filter sorted and projected by its options, titles encrypted
+// end-to-end are matched and sorted here.
+func GetAllNotesByTitle(connection net.Conn, filter TitleFilterData) ([]Note, error) {
+	// encrypted titles can only be matched here
+	if noteCipher.Active() && noteCipher.Titles {
+		notes, err := ListNotes(connection, ListOptions{Sort: filter.Sort, Desc: filter.Desc})
+		if err != nil {
+			return nil, err
+		}
+
+		notes = filterByTitle(notes, filter.Title)
+		filter.ProjectNotes(notes)
+		return notes, nil
+	}
+
+	note_slice := NoteSliceData{}
+	if err := Request(connection, GetLikeTitleNotesT, filter, &note_slice); err != nil {
+		return nil, err
+	}
+	noteCipher.DecryptNotes(note_slice.Notes)
+
+	return note_slice.Notes, nil
+}
+
+// Request sends a message of the given type with data as its payload and
+// unmarshals the payload of a successful reply into result, data and
+// result may be nil.
+func Request(connection net.Conn, Type int, data interface{}, result interface{}) error {
+	msg := MessageData{MessageTypeStatus: Type}
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg.Data = payload
 	}
 
-	msg := MessageData{MessageTypeStatus: DeleteNoteT, Data: note_data}
 	msg_data, err := json.Marshal(msg)
 	if err != nil {
 		return err
@@ -188,14 +286,29 @@ func DeleteNote(connection net.Conn, note Note) error {
 	}
 
 	bytes, err := GetMessageData(connection)
+	if err != nil {
+		return err
+	}
 
+	msg = MessageData{}
 	if err = json.Unmarshal(bytes, &msg); err != nil {
 		return err
 	}
 
 	switch msg.MessageTypeStatus {
 	case SuccessT:
-		return nil
+		if result == nil {
+			return nil
+		}
+
+		return json.Unmarshal(msg.Data, result)
+	case ConflictT:
+		conflict := ConflictData{}
+		if err = json.Unmarshal(msg.Data, &conflict); err != nil {
+			return err
+		}
+
+		return &ConflictError{Current: conflict.Note}
 	case ErrorT:
 		err_msg := ErrorMessageData{}
 		if err = json.Unmarshal(msg.Data, &err_msg); err != nil {
@@ -208,93 +321,605 @@ func DeleteNote(connection net.Conn, note Note) error {
 	}
 }
 
-func GetAllNotes(connection net.Conn) ([]Note, error) {
-	msg := MessageData{MessageTypeStatus: GetAllMyNotesT}
-	msg_data, err := json.Marshal(msg)
-	if err != nil {
+func GetTrashNotes(connection net.Conn) ([]Note, error) {
+	note_slice := NoteSliceData{}
+	if err := Request(connection, TrashNotesT, nil, &note_slice); err != nil {
 		return nil, err
 	}
+	noteCipher.DecryptNotes(note_slice.Notes)
 
-	if _, err = connection.Write(msg_data); err != nil {
+	return note_slice.Notes, nil
+}
+
+func RestoreNote(connection net.Conn, note Note) error {
+	return Request(connection, RestoreNoteT, note, nil)
+}
+
+func PurgeNote(connection net.Conn, note Note) error {
+	return Request(connection, PurgeNoteT, note, nil)
+}
+
+func TagNote(connection net.Conn, note_id int, tags []string) error {
+	return Request(connection, TagNoteT, TagData{NoteId: note_id, Tags: tags}, nil)
+}
+
+func UntagNote(connection net.Conn, note_id int, tags []string) error {
+	return Request(connection, UntagNoteT, TagData{NoteId: note_id, Tags: tags}, nil)
+}
+
+func GetTags(connection net.Conn) ([]TagCount, error) {
+	tag_slice := TagSliceData{}
+	if err := Request(connection, GetTagsT, nil, &tag_slice); err != nil {
 		return nil, err
 	}
 
-	bytes, err := GetMessageData(connection)
-	if err != nil {
+	return tag_slice.Tags, nil
+}
+
+func GetNotesByTags(connection net.Conn, filter TagFilterData) ([]Note, error) {
+	// encrypted titles are matched here, so they are projected here too
+	title, opts := "", filter.ListOptions
+	if noteCipher.Active() && noteCipher.Titles {
+		title, filter.Title, filter.Fields = filter.Title, "", nil
+	}
+
+	note_slice := NoteSliceData{}
+	if err := Request(connection, GetNotesByTagsT, filter, &note_slice); err != nil {
 		return nil, err
 	}
+	noteCipher.DecryptNotes(note_slice.Notes)
 
-	if err = json.Unmarshal(bytes, &msg); err != nil {
+	notes := filterByTitle(note_slice.Notes, title)
+	if noteCipher.Active() {
+		SortNotes(notes, opts)
+		opts.ProjectNotes(notes)
+	}
+
+	return notes, nil
+}
+
+func CreateNotebook(connection net.Conn, path string) error {
+	return Request(connection, NotebookCreateT, NotebookData{Path: path}, nil)
+}
+
+func RenameNotebook(connection net.Conn, path, name string) error {
+	return Request(connection, NotebookRenameT, NotebookData{Path: path, Name: name}, nil)
+}
+
+func MoveNotebook(connection net.Conn, path, parent string) error {
+	return Request(connection, NotebookMoveT, NotebookData{Path: path, Parent: parent}, nil)
+}
+
+func DeleteNotebook(connection net.Conn, path string) error {
+	return Request(connection, NotebookDeleteT, NotebookData{Path: path}, nil)
+}
+
+func ListNotebook(connection net.Conn, path string) (*NotebookListData, error) {
+	list := NotebookListData{}
+	if err := Request(connection, NotebookListT, NotebookData{Path: path}, &list); err != nil {
 		return nil, err
 	}
 
-	switch msg.MessageTypeStatus {
-	case SuccessT:
-		note_slice := NoteSliceData{}
-		if err = json.Unmarshal(msg.Data, &note_slice); err != nil {
+	noteCipher.DecryptNotes(list.Notes)
+	SortByTitle(list.Notes)
+
+	return &list, nil
+}
+
+func MoveNote(connection net.Conn, note_id int, path string) error {
+	return Request(connection, MoveNoteT, NotebookData{Path: path, NoteId: note_id}, nil)
+}
+
+// SearchNotes searches on the server, with encryption on the server can't
+// read the notes so they are searched here for the words of query.
+func SearchNotes(connection net.Conn, query string) ([]SearchResult, error) {
+	if noteCipher.Active() {
+		words := SearchWords(query)
+		if len(words) == 0 {
+			return nil, fmt.Errorf("search query has no words")
+		}
+
+		notes, err := GetAllNotes(connection)
+		if err != nil {
 			return nil, err
 		}
 
-		notes := make([]Note, 0, note_slice.Count)
-		notes = append(notes, note_slice.Notes...)
+		return MatchWords(notes, words, 100), nil
+	}
 
-		return notes, nil
-	case ErrorT:
-		err_msg := ErrorMessageData{}
-		if err = json.Unmarshal(msg.Data, &err_msg); err != nil {
+	results := SearchResultData{}
+	if err := Request(connection, SearchT, SearchData{Query: query}, &results); err != nil {
+		return nil, err
+	}
+
+	for i := range results.Results {
+		noteCipher.DecryptNote(&results.Results[i].Note)
+	}
+
+	return results.Results, nil
+}
+
+// FindNotes filters notes on the server, with encryption on only tag and
+// date terms are sent to it and text terms are matched here.
+func FindNotes(connection net.Conn, query string) ([]Note, error) {
+	if !noteCipher.Active() {
+		note_slice := NoteSliceData{}
+		if err := Request(connection, FindT, SearchData{Query: query}, &note_slice); err != nil {
 			return nil, err
 		}
+		noteCipher.DecryptNotes(note_slice.Notes)
 
-		return nil, fmt.Errorf(err_msg.ErrorText)
-	default:
-		return nil, fmt.Errorf("unknown server message code")
+		return note_slice.Notes, nil
 	}
-}
 
-func GetAllNotesByTitle(connection net.Conn, note Note) ([]Note, error) {
-	note_data, err := json.Marshal(note)
+	terms, err := ParseQuery(query)
 	if err != nil {
 		return nil, err
 	}
 
-	msg := MessageData{MessageTypeStatus: GetLikeTitleNotesT, Data: note_data}
-	msg_data, err := json.Marshal(msg)
+	server_terms := make([]string, 0)
+	text_terms := make([]QueryTerm, 0)
+	for _, term := range terms {
+		if term.IsTextTerm() {
+			text_terms = append(text_terms, term)
+		} else {
+			server_terms = append(server_terms, term.Token)
+		}
+	}
+
+	var notes []Note
+	if len(server_terms) == 0 {
+		notes, err = GetAllNotes(connection)
+	} else {
+		note_slice := NoteSliceData{}
+		err = Request(connection, FindT, SearchData{Query: strings.Join(server_terms, " ")}, &note_slice)
+		notes = note_slice.Notes
+		noteCipher.DecryptNotes(notes)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if _, err = connection.Write(msg_data); err != nil {
+	filtered := make([]Note, 0, len(notes))
+	for _, note := range notes {
+		matched := true
+		for _, term := range text_terms {
+			matched = matched && term.MatchNote(note)
+		}
+
+		if matched {
+			filtered = append(filtered, note)
+		}
+	}
+
+	return filtered, nil
+}
+
+func CreateShare(connection net.Conn, share ShareData) error {
+	return Request(connection, ShareT, share, nil)
+}
+
+func RevokeShare(connection net.Conn, share ShareData) error {
+	return Request(connection, RevokeShareT, share, nil)
+}
+
+func GetShares(connection net.Conn) ([]Share, error) {
+	shares := ShareSliceData{}
+	if err := Request(connection, GetSharesT, nil, &shares); err != nil {
 		return nil, err
 	}
 
-	bytes, err := GetMessageData(connection)
+	if noteCipher != nil {
+		for i := range shares.Shares {
+			if title, err := noteCipher.Decrypt(shares.Shares[i].NoteTitle); err == nil {
+				shares.Shares[i].NoteTitle = title
+			}
+		}
+	}
+
+	return shares.Shares, nil
+}
+
+func GetSharedWithMe(connection net.Conn) ([]SharedNote, error) {
+	notes := SharedNoteSliceData{}
+	if err := Request(connection, GetSharedWithMeT, nil, &notes); err != nil {
+		return nil, err
+	}
+
+	for i := range notes.Notes {
+		noteCipher.DecryptNote(&notes.Notes[i].Note)
+	}
+
+	return notes.Notes, nil
+}
+
+func CreateWorkspace(connection net.Conn, name string) error {
+	return Request(connection, WorkspaceCreateT, WorkspaceData{Name: name}, nil)
+}
+
+func SetWorkspaceMember(connection net.Conn, name, user_name, role string) error {
+	return Request(connection, WorkspaceMemberT, WorkspaceData{Name: name, UserName: user_name, Role: role}, nil)
+}
+
+func RemoveWorkspaceMember(connection net.Conn, name, user_name string) error {
+	return Request(connection, WorkspaceRemoveT, WorkspaceData{Name: name, UserName: user_name}, nil)
+}
+
+func GetWorkspaces(connection net.Conn) ([]Workspace, error) {
+	workspaces := WorkspaceSliceData{}
+	if err := Request(connection, WorkspacesT, nil, &workspaces); err != nil {
+		return nil, err
+	}
+
+	return workspaces.Workspaces, nil
+}
+
+func GetWorkspaceMembers(connection net.Conn, name string) ([]WorkspaceMember, error) {
+	members := WorkspaceMemberSliceData{}
+	if err := Request(connection, WorkspaceMembersT, WorkspaceData{Name: name}, &members); err != nil {
+		return nil, err
+	}
+
+	return members.Members, nil
+}
+
+func SwitchWorkspace(connection net.Conn, name string) error {
+	return Request(connection, WorkspaceSwitchT, WorkspaceData{Name: name}, nil)
+}
+
+func GetKeyCheck(connection net.Conn) (*KeyCheck, error) {
+	key := KeyCheck{}
+	if err := Request(connection, KeyCheckT, nil, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func SetKeyCheck(connection net.Conn, key KeyCheck) error {
+	return Request(connection, SetKeyCheckT, key, nil)
+}
+
+func GetNoteLinks(connection net.Conn, note_id int) ([]NoteLink, error) {
+	links := NoteLinkSliceData{}
+	if err := Request(connection, LinksT, Note{Id: note_id}, &links); err != nil {
+		return nil, err
+	}
+
+	if noteCipher != nil {
+		for i := range links.Links {
+			if title, err := noteCipher.Decrypt(links.Links[i].Title); err == nil {
+				links.Links[i].Title = title
+			}
+		}
+	}
+
+	return links.Links, nil
+}
+
+func GetBacklinks(connection net.Conn, note_id int) ([]Note, error) {
+	note_slice := NoteSliceData{}
+	if err := Request(connection, BacklinksT, Note{Id: note_id}, &note_slice); err != nil {
+		return nil, err
+	}
+	noteCipher.DecryptNotes(note_slice.Notes)
+
+	return note_slice.Notes, nil
+}
+
+// UploadAttachment sends the file at path to the server in chunks as an
+// attachment of the note, with end-to-end encryption every chunk is
+// encrypted on its own.
+func UploadAttachment(connection net.Conn, note_id int, path string) (*Attachment, error) {
+	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer f.Close()
 
-	if err = json.Unmarshal(bytes, &msg); err != nil {
+	info, err := f.Stat()
+	if err != nil {
 		return nil, err
 	}
 
-	switch msg.MessageTypeStatus {
-	case SuccessT:
-		note_slice := NoteSliceData{}
-		if err = json.Unmarshal(msg.Data, &note_slice); err != nil {
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a file", path)
+	}
+
+	attachment := Attachment{NoteId: note_id, Name: filepath.Base(path), Size: info.Size()}
+
+	chunk_size := AttachmentChunkSize
+	if noteCipher.Active() {
+		chunk_size -= noteCipher.Overhead()
+		chunks := (attachment.Size + int64(chunk_size) - 1) / int64(chunk_size)
+		attachment.Size += chunks * int64(noteCipher.Overhead())
+		attachment.Encrypted = true
+
+		if attachment.Name, err = noteCipher.Encrypt(attachment.Name); err != nil {
 			return nil, err
 		}
+	}
 
-		notes := make([]Note, 0, note_slice.Count)
-		notes = append(notes, note_slice.Notes...)
+	if err = Request(connection, AttachStartT, attachment, nil); err != nil {
+		return nil, err
+	}
 
-		return notes, nil
-	case ErrorT:
-		err_msg := ErrorMessageData{}
-		if err = json.Unmarshal(msg.Data, &err_msg); err != nil {
+	hash := sha256.New()
+	buf := make([]byte, chunk_size)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(f, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
 			return nil, err
 		}
 
-		return nil, fmt.Errorf(err_msg.ErrorText)
-	default:
-		return nil, fmt.Errorf("unknown server message code")
+		data := buf[:n]
+		if attachment.Encrypted {
+			if data, err = noteCipher.EncryptBytes(data); err != nil {
+				return nil, err
+			}
+		}
+		hash.Write(data)
+
+		if err = Request(connection, AttachChunkT, ChunkData{Seq: seq, Data: data}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &Attachment{}
+	if err = Request(connection, AttachFinishT, Attachment{Sha256: hex.EncodeToString(hash.Sum(nil))}, result); err != nil {
+		return nil, err
+	}
+
+	if result.Encrypted {
+		result.Name = filepath.Base(path)
+	}
+
+	return result, nil
+}
+
+func GetAttachments(connection net.Conn, note_id int) ([]Attachment, error) {
+	attachments := AttachmentSliceData{}
+	if err := Request(connection, AttachmentsT, Note{Id: note_id}, &attachments); err != nil {
+		return nil, err
 	}
+
+	if noteCipher != nil {
+		for i := range attachments.Attachments {
+			if name, err := noteCipher.Decrypt(attachments.Attachments[i].Name); err == nil {
+				attachments.Attachments[i].Name = name
+			}
+		}
+	}
+
+	return attachments.Attachments, nil
+}
+
+func DeleteAttachment(connection net.Conn, attachment_id int) error {
+	return Request(connection, DetachT, Attachment{Id: attachment_id}, nil)
+}
+
+// DownloadAttachment writes an attachment to path, which may be a directory
+// or empty for the current one, and returns the path of the file. Existing
+// files are not overwritten.
+func DownloadAttachment(connection net.Conn, attachment_id int, path string) (string, error) {
+	chunk := ChunkData{}
+	if err := Request(connection, DownloadT, ChunkData{AttachmentId: attachment_id}, &chunk); err != nil {
+		return "", err
+	}
+
+	attachment := chunk.Attachment
+	if attachment == nil {
+		return "", fmt.Errorf("server didn't send the attachment")
+	}
+
+	if attachment.Encrypted {
+		if noteCipher == nil {
+			return "", fmt.Errorf("attachment is encrypted, turn on encryption with your passphrase to download it")
+		}
+
+		name, err := noteCipher.Decrypt(attachment.Name)
+		if err != nil {
+			return "", err
+		}
+		attachment.Name = name
+	}
+
+	if info, err := os.Stat(path); path == "" || err == nil && info.IsDir() {
+		// the name comes from the server and must not point elsewhere
+		if err = checkAttachmentName(attachment.Name); err != nil {
+			return "", err
+		}
+		path = filepath.Join(path, attachment.Name)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if err = writeAttachment(connection, f, attachment, chunk.Data); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+
+	return path, f.Close()
+}
+
+func writeAttachment(connection net.Conn, w io.Writer, attachment *Attachment, first []byte) error {
+	hash := sha256.New()
+
+	for seq := 0; seq < attachment.Chunks || seq == 0; seq++ {
+		data := first
+		if seq > 0 {
+			chunk := ChunkData{}
+			if err := Request(connection, DownloadT, ChunkData{AttachmentId: attachment.Id, Seq: seq}, &chunk); err != nil {
+				return err
+			}
+			data = chunk.Data
+		}
+		hash.Write(data)
+
+		if attachment.Encrypted && len(data) > 0 {
+			var err error
+			if data, err = noteCipher.DecryptBytes(data); err != nil {
+				return err
+			}
+		}
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if hex.EncodeToString(hash.Sum(nil)) != attachment.Sha256 {
+		return fmt.Errorf("attachment was damaged in transfer, checksums differ")
+	}
+
+	return nil
+}
+
+func GetUsage(connection net.Conn) (*Usage, error) {
+	usage := &Usage{}
+	if err := Request(connection, UsageT, nil, usage); err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func SetNoteFlag(connection net.Conn, note_id int, flag string, value bool) error {
+	return Request(connection, FlagNoteT, NoteFlagData{NoteId: note_id, Flag: flag, Value: value}, nil)
+}
+
+// decryptReminderTitles decrypts titles of notes encrypted end-to-end.
+func decryptReminderTitles(reminders []Reminder) {
+	if noteCipher == nil {
+		return
+	}
+
+	for i := range reminders {
+		if title, err := noteCipher.Decrypt(reminders[i].Title); err == nil {
+			reminders[i].Title = title
+		}
+	}
+}
+
+func SetReminder(connection net.Conn, reminder Reminder) (*Reminder, error) {
+	set := []Reminder{{}}
+	if err := Request(connection, RemindT, reminder, &set[0]); err != nil {
+		return nil, err
+	}
+	decryptReminderTitles(set)
+
+	return &set[0], nil
+}
+
+func DeleteReminder(connection net.Conn, note_id int) error {
+	return Request(connection, UnremindT, Reminder{NoteId: note_id}, nil)
+}
+
+func GetReminders(connection net.Conn) ([]Reminder, error) {
+	reminders := ReminderSliceData{}
+	if err := Request(connection, UpcomingT, nil, &reminders); err != nil {
+		return nil, err
+	}
+	decryptReminderTitles(reminders.Reminders)
+
+	return reminders.Reminders, nil
+}
+
+// ChecklistItemRequest runs an item operation of Type and returns the items
+// of the checklist after it.
+func ChecklistItemRequest(connection net.Conn, Type int, item ChecklistItem) ([]ChecklistItem, error) {
+	if Type == ItemAddT && noteCipher.Active() {
+		text, err := noteCipher.Encrypt(item.Text)
+		if err != nil {
+			return nil, err
+		}
+		item.Text = text
+	}
+
+	items := ChecklistItemSliceData{}
+	if err := Request(connection, Type, item, &items); err != nil {
+		return nil, err
+	}
+	noteCipher.DecryptItems(items.Items)
+
+	return items.Items, nil
+}
+
+// Bulk runs ops in one transaction on the server, notes being created or
+// updated are encrypted first.
+func Bulk(connection net.Conn, ops []BulkOp) (*BulkResultData, error) {
+	for i := range ops {
+		if ops[i].Op == "create" || ops[i].Op == "update" {
+			if err := noteCipher.EncryptNote(&ops[i].Note); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result := &BulkResultData{}
+	if err := Request(connection, BulkT, BulkData{Ops: ops}, result); err != nil {
+		return nil, err
+	}
+
+	for _, res := range result.Results {
+		if res.Conflict != nil {
+			noteCipher.DecryptNote(res.Conflict)
+		}
+	}
+
+	return result, nil
+}
+
+// ExportNotes writes the notes of the current workspace, or the personal
+// ones outside of workspaces, to path in format and returns how many there
+// were. Notes are fetched and written a page at a time, on an error what
+// was written is removed.
+func ExportNotes(connection net.Conn, format, path string) (int, error) {
+	exporter, err := NewNoteExporter(format, path)
+	if err != nil {
+		return 0, err
+	}
+
+	count, after := 0, 0
+	for {
+		page := ExportData{}
+		if err = Request(connection, ExportT, ExportData{After: after}, &page); err != nil {
+			exporter.Abort()
+			return 0, err
+		}
+		noteCipher.DecryptNotes(page.Notes)
+
+		for i := range page.Notes {
+			note := &page.Notes[i]
+			if IsEncrypted(note.Title) || IsEncrypted(note.Data) {
+				exporter.Abort()
+				return 0, fmt.Errorf("note %d is encrypted, turn on encryption with your passphrase to export it", note.Id)
+			}
+
+			if err = exporter.Write(note); err != nil {
+				exporter.Abort()
+				return 0, err
+			}
+			count++
+		}
+
+		if page.Next == 0 {
+			break
+		}
+		after = page.Next
+	}
+
+	if err = exporter.Close(); err != nil {
+		exporter.Abort()
+		return 0, err
+	}
+
+	return count, nil
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"os"
 )
 
@@ -9,6 +10,29 @@ type ConfigFile struct {
 	MaxConn uint8  `json:"max_conn"`
 	Port    string `json:"port"`
 	Host    string `json:"host"`
+
+	// TrashMaxDays is how long deleted notes are kept in the trash before
+	// the server purges them, 0 keeps them until they are purged by hand.
+	TrashMaxDays int `json:"trash_max_days"`
+
+	// MasterKeyFile holds the key notes are encrypted with in the database,
+	// without it (and GOKEEPER_MASTER_KEY) notes are stored in plain.
+	MasterKeyFile string `json:"master_key_file"`
+
+	// RevealClearSeconds is how long the client keeps a revealed secret on
+	// the terminal before clearing it, 0 never clears it.
+	RevealClearSeconds int `json:"reveal_clear_seconds"`
+
+	// MaxAttachmentSize is the largest attachment the server accepts in
+	// bytes, 0 means 10 MB.
+	MaxAttachmentSize int64 `json:"max_attachment_size"`
+
+	// Quotas limit what every user may store, see Quotas.
+	Quotas
+
+	// DataSources are the databases the client runs SQL notes against by
+	// their names.
+	DataSources map[string]DataSource `json:"data_sources"`
 }
 
 func GetConfigFileData(fileName string) (*ConfigFile, error) {
@@ -17,8 +41,8 @@ func GetConfigFileData(fileName string) (*ConfigFile, error) {
 		return nil, err
 	}
 
-	confBuff := make([]byte, 256)
-	n, err := confFile.Read(confBuff)
+	// data sources make the file grow past any fixed buffer
+	confBuff, err := io.ReadAll(confFile)
 	if err != nil {
 		return nil, err
 	}
@@ -29,7 +53,7 @@ func GetConfigFileData(fileName string) (*ConfigFile, error) {
 	}
 
 	_data := ConfigFile{}
-	err = json.Unmarshal(confBuff[:n], &_data)
+	err = json.Unmarshal(confBuff, &_data)
 	if err != nil {
 		return nil, err
 	}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -26,17 +30,285 @@ CREATE TABLE "notes" (
 	"data_text"	TEXT NOT NULL
 )`
 
+// migrations are applied in order on top of schema, the index of the last
+// applied one is kept in the user_version pragma of the database file.
+var migrations = []string{
+	`ALTER TABLE "notes" ADD COLUMN "deleted_at" DATETIME`,
+	`CREATE TABLE "tags" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"name"	TEXT NOT NULL,
+	UNIQUE("user_id", "name")
+)`,
+	`CREATE TABLE "note_tags" (
+	"note_id"	INTEGER NOT NULL,
+	"tag_id"	INTEGER NOT NULL,
+	PRIMARY KEY("note_id", "tag_id")
+)`,
+	`CREATE TABLE "notebooks" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"parent_id"	INTEGER,
+	"name"	TEXT NOT NULL
+)`,
+	`ALTER TABLE "notes" ADD COLUMN "notebook_id" INTEGER`,
+	`ALTER TABLE "notes" ADD COLUMN "created_at" DATETIME`,
+	`ALTER TABLE "notes" ADD COLUMN "updated_at" DATETIME`,
+	`UPDATE "notes" SET "created_at"=CURRENT_TIMESTAMP, "updated_at"=CURRENT_TIMESTAMP`,
+	`ALTER TABLE "notes" ADD COLUMN "version" INTEGER NOT NULL DEFAULT 1`,
+	`CREATE TABLE "shares" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"owner_id"	INTEGER NOT NULL,
+	"user_id"	INTEGER NOT NULL,
+	"note_id"	INTEGER,
+	"notebook_id"	INTEGER,
+	"permission"	TEXT NOT NULL
+)`,
+	`CREATE TABLE "workspaces" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"name"	TEXT NOT NULL UNIQUE,
+	"owner_id"	INTEGER NOT NULL
+)`,
+	`CREATE TABLE "workspace_members" (
+	"workspace_id"	INTEGER NOT NULL,
+	"user_id"	INTEGER NOT NULL,
+	"role"	TEXT NOT NULL,
+	PRIMARY KEY("workspace_id", "user_id")
+)`,
+	`ALTER TABLE "notes" ADD COLUMN "workspace_id" INTEGER`,
+	`ALTER TABLE "notebooks" ADD COLUMN "workspace_id" INTEGER`,
+	// tags of a workspace have user_id 0, their names are unique per
+	// workspace instead of per user
+	`CREATE TABLE "tags_scoped" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"user_id"	INTEGER NOT NULL,
+	"workspace_id"	INTEGER,
+	"name"	TEXT NOT NULL
+);
+INSERT INTO "tags_scoped" ("id", "user_id", "name") SELECT "id", "user_id", "name" FROM "tags";
+DROP TABLE "tags";
+ALTER TABLE "tags_scoped" RENAME TO "tags";
+CREATE UNIQUE INDEX "tags_scope_name" ON "tags" ("user_id", ifnull("workspace_id", 0), "name")`,
+	`CREATE TABLE "user_keys" (
+	"user_id"	INTEGER NOT NULL PRIMARY KEY,
+	"salt"	TEXT NOT NULL,
+	"key_check"	TEXT NOT NULL,
+	"titles"	INTEGER NOT NULL DEFAULT 0
+)`,
+	// data keys of encryption at rest wrapped with the master key with id key_id
+	`ALTER TABLE "users" ADD COLUMN "data_key" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "users" ADD COLUMN "key_id" TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE "notes" ADD COLUMN "kind" TEXT NOT NULL DEFAULT 'plain'`,
+	`ALTER TABLE "notes" ADD COLUMN "language" TEXT NOT NULL DEFAULT ''`,
+	// target is the text between the brackets, encrypted at rest like titles
+	`CREATE TABLE "note_links" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"note_id"	INTEGER NOT NULL,
+	"position"	INTEGER NOT NULL,
+	"target"	TEXT NOT NULL,
+	"by_id"	INTEGER NOT NULL DEFAULT 0,
+	"target_id"	INTEGER
+);
+CREATE INDEX "note_links_note" ON "note_links" ("note_id");
+CREATE INDEX "note_links_target" ON "note_links" ("target_id")`,
+	`CREATE TABLE "attachments" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"note_id"	INTEGER NOT NULL,
+	"name"	TEXT NOT NULL,
+	"size"	INTEGER NOT NULL,
+	"chunks"	INTEGER NOT NULL,
+	"sha256"	TEXT NOT NULL,
+	"encrypted"	INTEGER NOT NULL DEFAULT 0,
+	"created_at"	DATETIME
+);
+CREATE INDEX "attachments_note" ON "attachments" ("note_id")`,
+	`CREATE TABLE "attachment_chunks" (
+	"attachment_id"	INTEGER NOT NULL,
+	"seq"	INTEGER NOT NULL,
+	"data"	BLOB NOT NULL,
+	PRIMARY KEY("attachment_id", "seq")
+)`,
+	`CREATE TABLE "blobs" (
+	"hash"	TEXT NOT NULL PRIMARY KEY,
+	"size"	INTEGER NOT NULL,
+	"data"	BLOB NOT NULL,
+	"refs"	INTEGER NOT NULL DEFAULT 0
+)`,
+	// chunks keep data until it is moved to the blob store at startup
+	`CREATE TABLE "attachment_chunks_blob" (
+	"attachment_id"	INTEGER NOT NULL,
+	"seq"	INTEGER NOT NULL,
+	"blob"	TEXT,
+	"data"	BLOB,
+	PRIMARY KEY("attachment_id", "seq")
+);
+INSERT INTO "attachment_chunks_blob" ("attachment_id", "seq", "data") SELECT "attachment_id", "seq", "data" FROM "attachment_chunks";
+DROP TABLE "attachment_chunks";
+ALTER TABLE "attachment_chunks_blob" RENAME TO "attachment_chunks";
+CREATE INDEX "attachment_chunks_blob" ON "attachment_chunks" ("blob")`,
+	`ALTER TABLE "notes" ADD COLUMN "pinned" INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE "notes" ADD COLUMN "favorite" INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE "reminders" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"note_id"	INTEGER NOT NULL,
+	"user_id"	INTEGER NOT NULL,
+	"due_at"	DATETIME NOT NULL,
+	"repeat"	TEXT NOT NULL DEFAULT '',
+	"created_at"	DATETIME,
+	UNIQUE("note_id", "user_id")
+);
+CREATE INDEX "reminders_due" ON "reminders" ("due_at")`,
+	`CREATE TABLE "checklist_items" (
+	"id"	INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT UNIQUE,
+	"note_id"	INTEGER NOT NULL,
+	"position"	INTEGER NOT NULL,
+	"text"	TEXT NOT NULL,
+	"checked"	INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX "checklist_items_note" ON "checklist_items" ("note_id", "position")`,
+	// data key a key rotation which has not finished yet re-encrypts with,
+	// wrapped with the new master key
+	`ALTER TABLE "users" ADD COLUMN "next_data_key" TEXT NOT NULL DEFAULT ''`,
+	// queries keep data_text until they are moved to the blob store at
+	// startup
+	`ALTER TABLE "notes" ADD COLUMN "body_blob" TEXT;
+CREATE INDEX "notes_body_blob" ON "notes" ("body_blob")`,
+	// key of the blob store wrapped with the master key
+	`CREATE TABLE "blob_key" (
+	"id"	INTEGER NOT NULL PRIMARY KEY CHECK ("id"=1),
+	"data_key"	TEXT NOT NULL,
+	"key_id"	TEXT NOT NULL
+)`,
+	// every user has favorites of their own, the ones marked before are
+	// kept for the owners of the notes
+	`CREATE TABLE "favorites" (
+	"user_id"	INTEGER NOT NULL,
+	"note_id"	INTEGER NOT NULL,
+	PRIMARY KEY("user_id", "note_id")
+);
+INSERT INTO "favorites" ("user_id", "note_id") SELECT "user_id", "id" FROM "notes" WHERE "favorite"=1;
+ALTER TABLE "notes" DROP COLUMN "favorite"`,
+}
+
+// DB is a database or a transaction on it, so notes can be read within a
+// transaction which writes them.
+type DB interface {
+	sqlx.Ext
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+	NamedExec(query string, arg interface{}) (sql.Result, error)
+}
+
 type User struct {
 	Id       int
 	UserName string `db:"user_name" json:"user_name"`
 	Password string `json:"password"`
+
+	DataKey     string `db:"data_key" json:"-"`
+	KeyId       string `db:"key_id" json:"-"`
+	NextDataKey string `db:"next_data_key" json:"-"`
+
+	// Workspace is the workspace the session works in, nil for the
+	// personal notes of the user.
+	Workspace *Workspace `db:"-" json:"-"`
+
+	// Upload is the attachment the session is uploading.
+	Upload *Upload `db:"-" json:"-"`
 }
 
 type Note struct {
-	Id     int
-	UserId int    `db:"user_id" json:"user_id"`
-	Title  string `db:"title" json:"title"`
-	Data   string `db:"data_text" json:"data_text"`
+	Id        int
+	UserId    int        `db:"user_id" json:"user_id"`
+	Title     string     `db:"title" json:"title"`
+	Data      string     `db:"data_text" json:"data_text"`
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+	Tags      []string   `db:"-" json:"tags,omitempty"`
+
+	NotebookId *int `db:"notebook_id" json:"notebook_id,omitempty"`
+	// Notebook is the path of the notebook the note is in, empty for the root.
+	Notebook string `db:"-" json:"notebook,omitempty"`
+
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+
+	// Version is increased on every update, updates and deletes must carry
+	// the version they are based on.
+	Version int `db:"version" json:"version"`
+
+	WorkspaceId *int `db:"workspace_id" json:"workspace_id,omitempty"`
+
+	// BodyBlob is the hash of the query in the blob store, the query is
+	// read from there by OpenNotes.
+	BodyBlob *string `db:"body_blob" json:"-"`
+
+	// Kind is one of the note kinds below, an empty kind in an update
+	// keeps the current one.
+	Kind string `db:"kind" json:"kind,omitempty"`
+
+	// Language is what the query is written in, see NormalizeLanguage. An
+	// empty language in an update keeps the current one, "none" clears it.
+	Language string `db:"language" json:"language,omitempty"`
+
+	// Pinned notes come first in lists.
+	Pinned bool `db:"pinned" json:"pinned,omitempty"`
+
+	// Favorite is set when the user reading the note marked it as a
+	// favorite.
+	Favorite bool `db:"-" json:"favorite,omitempty"`
+
+	// Items are the items of a checklist note.
+	Items []ChecklistItem `db:"-" json:"items,omitempty"`
+
+	// RewriteLinks is set in an update renaming the note to rewrite links
+	// to its old title in other notes.
+	RewriteLinks bool `db:"-" json:"rewrite_links,omitempty"`
+}
+
+// Note kinds. Queries of secret notes are masked by the client until they
+// are revealed, templates are filled in by the client to create notes and
+// checklists have items which are checked one at a time.
+const (
+	NotePlain     = "plain"
+	NoteSecret    = "secret"
+	NoteSnippet   = "snippet"
+	NoteTemplate  = "template"
+	NoteChecklist = "checklist"
+)
+
+func CheckNoteKind(kind string) error {
+	switch kind {
+	case NotePlain, NoteSecret, NoteSnippet, NoteTemplate, NoteChecklist:
+		return nil
+	}
+
+	return fmt.Errorf("unknown note kind \"%s\", use plain, secret, snippet, template or checklist", kind)
+}
+
+// ConflictError is returned when a note was changed since the version the
+// client based its change on.
+type ConflictError struct {
+	Current Note
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("note %d was changed meanwhile, current version is %d", err.Current.Id, err.Current.Version)
+}
+
+func checkNoteVersion(note *Note, version int) error {
+	if version == 0 {
+		return fmt.Errorf("note version is required")
+	}
+
+	if version != note.Version {
+		return &ConflictError{Current: *note}
+	}
+
+	return nil
+}
+
+type TagCount struct {
+	Name  string `db:"name" json:"name"`
+	Count int    `db:"count" json:"count"`
 }
 
 func CreateConn(driverName, dataSourceName string) (*sqlx.DB, error) {
@@ -54,7 +326,58 @@ func CreateConn(driverName, dataSourceName string) (*sqlx.DB, error) {
 		db.MustBegin()
 	}
 
-	return sqlx.Connect(driverName, dataSourceName)
+	db, err := sqlx.Connect(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = moveChunksToBlobs(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = moveBodiesToBlobs(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err = SetupFullTextSearch(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func Migrate(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, "pragma user_version"); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		tx := db.MustBegin()
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", version+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("pragma user_version=%d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (data *User) CreateUser(db *sqlx.DB) error {
@@ -74,11 +397,19 @@ func (data *User) CreateUser(db *sqlx.DB) error {
 	data.Password = string(hashedPassword)
 
 	tx := db.MustBegin()
-	_, err = tx.NamedExec("insert into users (user_name, password) values (:user_name, :password)", data)
+	defer tx.Rollback()
+
+	res, err := tx.NamedExec("insert into users (user_name, password) values (:user_name, :password)", data)
 	if err != nil {
 		return err
 	}
 
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	data.Id = int(id)
+
 	return tx.Commit()
 }
 
@@ -104,7 +435,8 @@ func CheckUserPassword(db *sqlx.DB, user_name, password string) (bool, error) {
 }
 
 func (user *User) GetNotesNumberByUserId(db *sqlx.DB) (count int, err error) {
-	row := db.QueryRow("select count(*) from notes where user_id=$1", user.Id)
+	scope, args := user.Scope().Where("")
+	row := db.QueryRow("select count(*) from notes where "+scope+" and deleted_at is null", args...)
 	err = row.Scan(&count)
 	if err != nil {
 		return 0, err
@@ -113,27 +445,26 @@ func (user *User) GetNotesNumberByUserId(db *sqlx.DB) (count int, err error) {
 	return count, nil
 }
 
-func (user *User) GetNotesNumberByTitle(db *sqlx.DB, title string) (int, error) {
-	var count int
+func (user *User) GetNotesByTitle(db *sqlx.DB, title string) ([]Note, error) {
+	// encrypted titles are matched after decryption
+	if EncryptedAtRest() {
+		notes, err := user.GetNotesByUser(db)
+		if err != nil {
+			return nil, err
+		}
 
-	row := db.QueryRow("select count(*) from notes where user_id=? and title like ?", user.Id, "%"+title+"%")
-	err := row.Scan(&count)
-	if err != nil {
-		return 0, err
+		return filterByTitle(notes, title), nil
 	}
 
-	return count, nil
-}
-
-func (user *User) GetNotesByTitle(db *sqlx.DB, title string) ([]Note, error) {
-	count, err := user.GetNotesNumberByTitle(db, title)
+	scope, args := user.Scope().Where("")
+	notes := make([]Note, 0)
+	err := db.Select(&notes, "select * from notes where "+scope+" and title like ? and deleted_at is null order by pinned desc, id",
+		append(args, "%"+title+"%")...)
 	if err != nil {
 		return nil, err
 	}
 
-	notes := make([]Note, 0, count)
-	err = db.Select(&notes, "select * from notes where user_id=? and title like ?", user.Id, "%"+title+"%")
-	if err != nil {
+	if err = user.LoadNoteDetails(db, notes); err != nil {
 		return nil, err
 	}
 
@@ -141,31 +472,116 @@ func (user *User) GetNotesByTitle(db *sqlx.DB, title string) ([]Note, error) {
 }
 
 func (data *Note) CreateNote(db *sqlx.DB, user *User) error {
-	notes, err := user.GetNotesByTitle(db, data.Title)
+	if err := PrepareDataKeys(db, user.Id); err != nil {
+		return err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := data.createNote(tx, user); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (data *Note) createNote(tx *sqlx.Tx, user *User) error {
+	if err := user.RequireScopePermission(tx, PermWrite); err != nil {
+		return err
+	}
+
+	notebook, err := user.GetNotebookByPath(tx, data.Notebook)
 	if err != nil {
 		return err
 	}
+	data.NotebookId = notebook.IdPtr()
 
-	for _, note := range notes {
-		if note.Title == data.Title {
-			return fmt.Errorf("note with \"%s\" name already exists", data.Title)
+	exists, err := NoteTitleExists(tx, user.Scope(), data.Title, data.NotebookId, 0)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("note with \"%s\" name already exists", data.Title)
+	}
+
+	if data.Kind == "" {
+		data.Kind = NotePlain
+	}
+
+	if err = CheckNoteKind(data.Kind); err != nil {
+		return err
+	}
+
+	if data.Language != "" {
+		if data.Language, err = NormalizeLanguage(data.Language); err != nil {
+			return err
 		}
 	}
 
 	data.UserId = user.Id
-	tx := db.MustBegin()
-	_, err = tx.NamedExec("insert into notes (user_id, title, data_text) values (:user_id, :title, :data_text)", data)
+	data.WorkspaceId = user.Workspace.IdPtr()
+
+	sealed := *data
+	if err = SealNote(tx, &sealed); err != nil {
+		return err
+	}
+
+	items := make([]string, 0, len(data.Items))
+	size := int64(NoteSize(&sealed))
+	if data.Kind == NoteChecklist {
+		for _, item := range data.Items {
+			items = append(items, item.Text)
+			size += int64(len(item.Text))
+		}
+	}
+
+	if err = user.CheckQuota(tx, 1, size); err != nil {
+		return err
+	}
+
+	if err = putNoteBody(tx, &sealed); err != nil {
+		return err
+	}
+
+	res, err := tx.NamedExec(`insert into notes (user_id, workspace_id, title, data_text, body_blob, notebook_id, kind, language,
+		created_at, updated_at) values (:user_id, :workspace_id, :title, :data_text, :body_blob, :notebook_id, :kind, :language,
+		CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, sealed)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	data.Id = int(id)
+
+	if err = addNoteTags(tx, user.Scope(), data.Id, data.Tags); err != nil {
+		return err
+	}
+
+	if err = addChecklistItems(tx, data, items); err != nil {
+		return err
+	}
+
+	if err = saveNoteLinks(tx, data); err != nil {
+		return err
+	}
+
+	if err = resolveLinks(tx, user.Scope()); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 func (user *User) GetNotesNumberByUser(db *sqlx.DB) (int, error) {
 	var count int
 
-	row := db.QueryRow("select count(*) from notes where user_id=?", user.Id)
+	scope, args := user.Scope().Where("")
+	row := db.QueryRow("select count(*) from notes where "+scope+" and deleted_at is null", args...)
 	err := row.Scan(&count)
 	if err != nil {
 		return 0, err
@@ -175,60 +591,809 @@ func (user *User) GetNotesNumberByUser(db *sqlx.DB) (int, error) {
 }
 
 func (user *User) GetNotesByUser(db *sqlx.DB) ([]Note, error) {
+	return user.ListNotes(db, ListOptions{})
+}
+
+// ListNotes returns the notes of the scope sorted and projected by opts.
+func (user *User) ListNotes(db *sqlx.DB, opts ListOptions) ([]Note, error) {
+	if err := opts.Check(); err != nil {
+		return nil, err
+	}
+
 	count, err := user.GetNotesNumberByUser(db)
 	if err != nil {
 		return nil, err
 	}
 
+	scope, args := user.Scope().Where("")
 	notes := make([]Note, 0, count)
-	err = db.Select(&notes, "select * from notes where user_id=?", user.Id)
+	err = db.Select(&notes, "select "+opts.noteColumns("")+" from notes where "+scope+
+		" and deleted_at is null order by pinned desc, id", args...)
 	if err != nil {
 		return nil, err
 	}
 
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	// titles encrypted at rest are only sorted after they were opened
+	SortNotes(notes, opts)
+	opts.ProjectNotes(notes)
 	return notes, nil
 }
 
-func (user *User) GetNoteById(db *sqlx.DB, note_id int) (*Note, error) {
-	var note Note
+// GetNoteById returns a note the user owns or which is shared with them.
+func (user *User) GetNoteById(db DB, note_id int) (*Note, error) {
+	return user.GetNoteWithPermission(db, note_id, PermRead)
+}
 
-	err := db.Get(&note, "select * from notes where id=$1 and user_id=$2", note_id, user.Id)
-	if err != nil {
-		return nil, err
+func (user *User) EditNoteById(db *sqlx.DB, new_note Note) error {
+	if err := PrepareNoteKeys(db, new_note.Id); err != nil {
+		return err
 	}
 
-	return &note, nil
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := user.editNote(tx, new_note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (user *User) EditNoteById(db *sqlx.DB, new_note Note) error {
-	note, err := user.GetNoteById(db, new_note.Id)
+func (user *User) editNote(tx *sqlx.Tx, new_note Note) error {
+	note, err := user.GetNoteWithPermission(tx, new_note.Id, PermWrite)
 	if err != nil {
 		return err
 	}
 
-	note.Title = new_note.Title
-	note.Data = new_note.Data
+	if err = checkNoteVersion(note, new_note.Version); err != nil {
+		return err
+	}
 
-	tx := db.MustBegin()
-	_, err = tx.NamedExec("update notes set title=:title, data_text=:data_text where id=:id", note)
+	sealed := *note
+	sealed.Title = new_note.Title
+	sealed.Data = new_note.Data
+	if new_note.Kind != "" {
+		if err = CheckNoteKind(new_note.Kind); err != nil {
+			return err
+		}
+		sealed.Kind = new_note.Kind
+	}
+
+	if new_note.Language != "" {
+		if sealed.Language, err = NormalizeLanguage(new_note.Language); err != nil {
+			return err
+		}
+	}
+
+	renamed := sealed.Title != note.Title
+	if renamed {
+		exists, err := NoteTitleExists(tx, NoteScope(note), sealed.Title, note.NotebookId, note.Id)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return fmt.Errorf("note with \"%s\" name already exists", sealed.Title)
+		}
+	}
+
+	if renamed && new_note.RewriteLinks {
+		// links of the note to itself
+		sealed.Data = RewriteLinkTitle(sealed.Data, note.Title, sealed.Title)
+	}
+	plain := sealed
+
+	if plain.Kind == NoteChecklist {
+		if err = checkChecklistSize(tx, &plain, nil); err != nil {
+			return err
+		}
+	}
+
+	if err = SealNote(tx, &sealed); err != nil {
+		return err
+	}
+
+	// the owner pays for the note whoever edits it
+	var old_size int64
+	err = tx.Get(&old_size, "select length(cast(title as blob))+"+noteBodySize("")+" from notes where id=?", note.Id)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	owner := User{Id: note.UserId}
+	if err = owner.CheckQuota(tx, 0, int64(NoteSize(&sealed))-old_size); err != nil {
+		return err
+	}
+
+	if err = putNoteBody(tx, &sealed); err != nil {
+		return err
+	}
+
+	// the version is checked again by the update itself in case the note
+	// was changed after it was read
+	res, err := tx.NamedExec(`update notes set title=:title, data_text=:data_text, body_blob=:body_blob, kind=:kind,
+		language=:language, updated_at=CURRENT_TIMESTAMP, version=version+1 where id=:id and version=:version`, sealed)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return user.noteConflict(tx, note.Id, err)
+	}
+
+	if err = releaseNoteBody(tx, note); err != nil {
+		return err
+	}
+
+	// tags are only replaced when the client sent them
+	if new_note.Tags != nil {
+		if _, err = tx.Exec("delete from note_tags where note_id=?", note.Id); err != nil {
+			return err
+		}
+
+		if err = addNoteTags(tx, NoteScope(note), note.Id, new_note.Tags); err != nil {
+			return err
+		}
+	}
+
+	if err = saveNoteLinks(tx, &plain); err != nil {
+		return err
+	}
+
+	if renamed {
+		if err = user.relinkRenamed(tx, &plain, note.Title, new_note.RewriteLinks); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// DeleteNoteById moves the note to the trash, it stays there until it is
+// restored or purged.
 func (user *User) DeleteNoteById(db *sqlx.DB, new_note Note) error {
-	note, err := user.GetNoteById(db, new_note.Id)
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := user.deleteNote(tx, new_note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (user *User) deleteNote(tx *sqlx.Tx, new_note Note) error {
+	note, err := user.GetNoteWithPermission(tx, new_note.Id, PermOwner)
 	if err != nil {
 		return err
 	}
 
-	tx := db.MustBegin()
-	_, err = tx.NamedExec("delete from notes where id=:id", note)
+	if err = checkNoteVersion(note, new_note.Version); err != nil {
+		return err
+	}
+
+	res, err := tx.NamedExec("update notes set deleted_at=CURRENT_TIMESTAMP where id=:id and version=:version", note)
 	if err != nil {
 		return err
 	}
 
-	return tx.Commit()
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return user.noteConflict(tx, note.Id, err)
+	}
+
+	return nil
+}
+
+// noteConflict builds the error for an update which didn't match the
+// version of the note.
+func (user *User) noteConflict(db DB, note_id int, err error) error {
+	if err != nil {
+		return err
+	}
+
+	note, err := user.GetNoteById(db, note_id)
+	if err != nil {
+		return err
+	}
+
+	return &ConflictError{Current: *note}
+}
+
+// GetTrashNoteById returns a note from the trash of the active scope if the
+// user has at least perm on it.
+func (user *User) GetTrashNoteById(db *sqlx.DB, note_id int, perm Permission) (*Note, error) {
+	var note Note
+
+	scope, args := user.Scope().Where("")
+	err := db.Get(&note, "select * from notes where id=? and "+scope+" and deleted_at is not null",
+		append([]interface{}{note_id}, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("note with id %d is not in the trash", note_id)
+	}
+
+	notes := []Note{note}
+	if err = OpenNotes(db, notes); err != nil {
+		return nil, err
+	}
+	note = notes[0]
+
+	has, err := user.NotePermission(db, &note)
+	if err != nil {
+		return nil, err
+	}
+
+	if has < perm {
+		return nil, fmt.Errorf("you need %s permission on note %d", perm, note_id)
+	}
+
+	return &note, nil
+}
+
+func (user *User) GetTrashNotes(db *sqlx.DB) ([]Note, error) {
+	scope, args := user.Scope().Where("")
+	notes := make([]Note, 0)
+	err := db.Select(&notes, "select * from notes where "+scope+" and deleted_at is not null order by deleted_at desc", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	return notes, nil
+}
+
+func (user *User) RestoreNoteById(db *sqlx.DB, note_id int) error {
+	note, err := user.GetTrashNoteById(db, note_id, PermWrite)
+	if err != nil {
+		return err
+	}
+
+	exists, err := NoteTitleExists(db, NoteScope(note), note.Title, note.NotebookId, note.Id)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("note with \"%s\" name already exists, rename it before restoring", note.Title)
+	}
+
+	tx := db.MustBegin()
+	_, err = tx.NamedExec("update notes set deleted_at=null where id=:id", note)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeNoteById permanently removes a note, only notes in the trash can be purged.
+func (user *User) PurgeNoteById(db *sqlx.DB, note_id int) error {
+	note, err := user.GetTrashNoteById(db, note_id, PermOwner)
+	if err != nil {
+		return err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if _, err = tx.NamedExec("delete from note_tags where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from shares where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from favorites where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from note_links where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from reminders where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from checklist_items where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if err = releaseChunkBlobs(tx, "select id from attachments where note_id=?", note.Id); err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExec("delete from attachment_chunks where attachment_id in (select id from attachments where note_id=:id)", note)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from attachments where note_id=:id", note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("update note_links set target_id=null where target_id=:id", note); err != nil {
+		return err
+	}
+
+	if err = releaseNoteBody(tx, note); err != nil {
+		return err
+	}
+
+	if _, err = tx.NamedExec("delete from notes where id=:id", note); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeTrash permanently removes notes of all users which were moved to the
+// trash more than age ago and returns how many of them were removed.
+func PurgeTrash(db *sqlx.DB, age time.Duration) (int64, error) {
+	modifier := fmt.Sprintf("-%d seconds", int64(age.Seconds()))
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	expired := `select a.id from attachments a join notes n on n.id=a.note_id
+		where n.deleted_at is not null and n.deleted_at < datetime('now', ?)`
+	if err := releaseChunkBlobs(tx, expired, modifier); err != nil {
+		return 0, err
+	}
+
+	_, err := tx.Exec("delete from attachment_chunks where attachment_id in ("+expired+")", modifier)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, table := range []string{"note_tags", "shares", "note_links", "reminders", "checklist_items", "attachments",
+		"favorites"} {
+		_, err := tx.Exec(`delete from `+table+` where note_id in
+			(select id from notes where deleted_at is not null and deleted_at < datetime('now', ?))`, modifier)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec(`update note_links set target_id=null where target_id in
+		(select id from notes where deleted_at is not null and deleted_at < datetime('now', ?))`, modifier)
+	if err != nil {
+		return 0, err
+	}
+
+	err = releaseBodyBlobs(tx, "select id from notes where deleted_at is not null and deleted_at < datetime('now', ?)", modifier)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec("delete from notes where deleted_at is not null and deleted_at < datetime('now', ?)", modifier)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return n, tx.Commit()
+}
+
+// FindNotes returns notes matching a filter query, see ParseQuery.
+func (user *User) FindNotes(db *sqlx.DB, query string) ([]Note, error) {
+	terms, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	// encrypted text is matched after decryption, the rest by SQL
+	text_terms := make([]QueryTerm, 0)
+	if EncryptedAtRest() {
+		sql_terms := make([]QueryTerm, 0, len(terms))
+		for _, term := range terms {
+			if term.IsTextTerm() {
+				text_terms = append(text_terms, term)
+			} else {
+				sql_terms = append(sql_terms, term)
+			}
+		}
+		terms = sql_terms
+	}
+
+	where, args := CompileQuery(terms, user.Id)
+	if where == "" {
+		where = "1"
+	}
+	scope, scope_args := user.Scope().Where("n.")
+
+	notes := make([]Note, 0)
+	err = db.Select(&notes, "select n.* from notes n where "+scope+" and n.deleted_at is null and "+where+" order by n.pinned desc, n.id",
+		append(scope_args, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	matched := notes[:0]
+	for _, note := range notes {
+		ok := true
+		for _, term := range text_terms {
+			ok = ok && term.MatchNote(note)
+		}
+
+		if ok {
+			matched = append(matched, note)
+		}
+	}
+
+	return matched, nil
+}
+
+// NoteTitleExists reports whether a note of the scope outside of the trash
+// other than the one with except id already has title in the notebook.
+// Notes shared with the user from other scopes don't count.
+func NoteTitleExists(db DB, scope Scope, title string, notebook_id *int, except int) (bool, error) {
+	var count int
+
+	where, args := scope.Where("")
+	if EncryptedAtRest() {
+		// encrypted titles differ even when they are equal
+		notes := make([]Note, 0)
+		err := db.Select(&notes, "select * from notes where "+where+` and notebook_id is ?
+			and deleted_at is null and id<>?`, append(args, notebook_id, except)...)
+		if err != nil {
+			return false, err
+		}
+
+		if err = OpenNotes(db, notes); err != nil {
+			return false, err
+		}
+
+		for _, note := range notes {
+			if note.Title == title {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	err := db.Get(&count, "select count(*) from notes where "+where+` and title=? and notebook_id is ?
+		and deleted_at is null and id<>?`, append(args, title, notebook_id, except)...)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// filterByTitle returns notes whose titles contain title ignoring case.
+func filterByTitle(notes []Note, title string) []Note {
+	if title == "" {
+		return notes
+	}
+
+	filtered := make([]Note, 0, len(notes))
+	for _, note := range notes {
+		if strings.Contains(strings.ToLower(note.Title), strings.ToLower(title)) {
+			filtered = append(filtered, note)
+		}
+	}
+
+	return filtered
+}
+
+// SortByTitle orders notes by title with pinned notes first.
+func SortByTitle(notes []Note) {
+	sort.SliceStable(notes, func(i, j int) bool {
+		if notes[i].Pinned != notes[j].Pinned {
+			return notes[i].Pinned
+		}
+		return notes[i].Title < notes[j].Title
+	})
+}
+
+// SetNoteFlag pins or unpins a note the user may write or marks a note
+// the user may read as a favorite of theirs or not, flag is pinned or
+// favorite. It doesn't change the version of the note.
+func (user *User) SetNoteFlag(db *sqlx.DB, note_id int, flag string, value bool) error {
+	perm := PermRead
+	switch flag {
+	case "pinned":
+		perm = PermWrite
+	case "favorite":
+	default:
+		return fmt.Errorf("unknown flag \"%s\", use pinned or favorite", flag)
+	}
+
+	note, err := user.GetNoteWithPermission(db, note_id, perm)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case flag == "pinned":
+		_, err = db.Exec("update notes set pinned=? where id=?", value, note.Id)
+	case value:
+		_, err = db.Exec("insert or ignore into favorites (user_id, note_id) values (?, ?)", user.Id, note.Id)
+	default:
+		_, err = db.Exec("delete from favorites where user_id=? and note_id=?", user.Id, note.Id)
+	}
+	return err
+}
+
+// LoadNoteDetails fills in the fields of notes which are not stored in the
+// notes table and decrypts them, favorites are the ones of user.
+func (user *User) LoadNoteDetails(db DB, notes []Note) error {
+	if err := OpenNotes(db, notes); err != nil {
+		return err
+	}
+
+	if err := LoadNoteTags(db, notes); err != nil {
+		return err
+	}
+
+	if err := user.loadFavorites(db, notes); err != nil {
+		return err
+	}
+
+	if err := LoadChecklistItems(db, notes); err != nil {
+		return err
+	}
+
+	return LoadNotebookPaths(db, notes)
+}
+
+// NormalizeTags lowercases and trims tag names, drops empty ones and
+// duplicates and returns them sorted.
+func NormalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	result := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		if strings.ContainsAny(tag, " \t,") {
+			return nil, fmt.Errorf("tag \"%s\" must not contain spaces or commas", tag)
+		}
+
+		seen[tag] = true
+		result = append(result, tag)
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// addNoteTags attaches tags of the scope to the note creating the missing
+// ones, tags of a workspace don't belong to any single user.
+func addNoteTags(tx *sqlx.Tx, scope Scope, note_id int, tags []string) error {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+
+	owner_id := scope.UserId
+	if scope.WorkspaceId != nil {
+		owner_id = 0
+	}
+
+	where, args := scope.Where("")
+	for _, tag := range tags {
+		_, err = tx.Exec("insert or ignore into tags (user_id, workspace_id, name) values (?, ?, ?)",
+			owner_id, scope.WorkspaceId, tag)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`insert or ignore into note_tags (note_id, tag_id)
+			select ?, id from tags where `+where+` and name=?`, append(append([]interface{}{note_id}, args...), tag)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadFavorites sets Favorite of the notes which are favorites of user.
+func (user *User) loadFavorites(db DB, notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int, len(notes))
+	ids := make([]int, 0, len(notes))
+	for i := range notes {
+		index[notes[i].Id] = i
+		ids = append(ids, notes[i].Id)
+	}
+
+	query, args, err := sqlx.In("select note_id from favorites where user_id=? and note_id in (?)", user.Id, ids)
+	if err != nil {
+		return err
+	}
+
+	favorites := make([]int, 0)
+	if err = db.Select(&favorites, db.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	for _, note_id := range favorites {
+		notes[index[note_id]].Favorite = true
+	}
+
+	return nil
+}
+
+// LoadNoteTags fills in the Tags field of every note in notes.
+func LoadNoteTags(db DB, notes []Note) error {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	index := make(map[int]int, len(notes))
+	ids := make([]int, 0, len(notes))
+	for i := range notes {
+		index[notes[i].Id] = i
+		ids = append(ids, notes[i].Id)
+	}
+
+	query, args, err := sqlx.In(`select nt.note_id, t.name from note_tags nt
+		join tags t on t.id=nt.tag_id where nt.note_id in (?) order by t.name`, ids)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(db.Rebind(query), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var note_id int
+		var name string
+		if err = rows.Scan(&note_id, &name); err != nil {
+			return err
+		}
+
+		i := index[note_id]
+		notes[i].Tags = append(notes[i].Tags, name)
+	}
+
+	return rows.Err()
+}
+
+// TagNoteById adds tags to a note the user may write, the tags belong to
+// the scope of the note.
+func (user *User) TagNoteById(db *sqlx.DB, note_id int, tags []string) error {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := user.tagNote(tx, note_id, tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (user *User) tagNote(tx *sqlx.Tx, note_id int, tags []string) error {
+	note, err := user.GetNoteWithPermission(tx, note_id, PermWrite)
+	if err != nil {
+		return err
+	}
+
+	return addNoteTags(tx, NoteScope(note), note_id, tags)
+}
+
+func (user *User) UntagNoteById(db *sqlx.DB, note_id int, tags []string) error {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := user.untagNote(tx, note_id, tags); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (user *User) untagNote(tx *sqlx.Tx, note_id int, tags []string) error {
+	note, err := user.GetNoteWithPermission(tx, note_id, PermWrite)
+	if err != nil {
+		return err
+	}
+
+	tags, err = NormalizeTags(tags)
+	if err != nil {
+		return err
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	where, scope_args := NoteScope(note).Where("")
+	query, args, err := sqlx.In(`delete from note_tags where note_id=? and tag_id in
+		(select id from tags where `+where+` and name in (?))`, append(append([]interface{}{note_id}, scope_args...), tags)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(tx.Rebind(query), args...)
+	return err
+}
+
+// GetTags returns every tag of the active scope which is attached to at least one
+// note outside of the trash together with the number of such notes.
+func (user *User) GetTags(db *sqlx.DB) ([]TagCount, error) {
+	where, args := user.Scope().Where("t.")
+	tags := make([]TagCount, 0)
+	err := db.Select(&tags, `select t.name as name, count(n.id) as count from tags t
+		join note_tags nt on nt.tag_id=t.id
+		join notes n on n.id=nt.note_id and n.deleted_at is null
+		where `+where+` group by t.name order by t.name`, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// GetNotesByTags returns notes having all (match_all) or any of tags, when
+// title is not empty only notes with a matching title are returned.
+func (user *User) GetNotesByTags(db *sqlx.DB, tags []string, match_all bool, title string) ([]Note, error) {
+	tags, err := NormalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tags given")
+	}
+
+	having := ""
+	if match_all {
+		having = fmt.Sprintf(" having count(distinct t.id)=%d", len(tags))
+	}
+
+	filter := ""
+	if EncryptedAtRest() {
+		filter, title = title, ""
+	}
+
+	where, scope_args := user.Scope().Where("n.")
+	query, args, err := sqlx.In(`select n.* from notes n
+		join note_tags nt on nt.note_id=n.id
+		join tags t on t.id=nt.tag_id
+		where `+where+` and n.deleted_at is null and n.title like ? and t.name in (?)
+		group by n.id`+having+" order by n.pinned desc, n.id", append(scope_args, "%"+title+"%", tags)...)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]Note, 0)
+	if err = db.Select(&notes, db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	return filterByTitle(notes, filter), nil
 }
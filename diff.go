@@ -0,0 +1,54 @@
+package main
+
+import "strings"
+
+// LineDiff compares a and b line by line and returns the lines of both
+// prefixed with "- " for removed, "+ " for added and "  " for kept lines.
+func LineDiff(a, b string) []string {
+	old_lines, new_lines := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// old_lines[i:] and new_lines[j:]
+	lcs := make([][]int, len(old_lines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(new_lines)+1)
+	}
+
+	for i := len(old_lines) - 1; i >= 0; i-- {
+		for j := len(new_lines) - 1; j >= 0; j-- {
+			if old_lines[i] == new_lines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	result := make([]string, 0, len(old_lines)+len(new_lines))
+	i, j := 0, 0
+	for i < len(old_lines) && j < len(new_lines) {
+		switch {
+		case old_lines[i] == new_lines[j]:
+			result = append(result, "  "+old_lines[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, "- "+old_lines[i])
+			i++
+		default:
+			result = append(result, "+ "+new_lines[j])
+			j++
+		}
+	}
+
+	for ; i < len(old_lines); i++ {
+		result = append(result, "- "+old_lines[i])
+	}
+	for ; j < len(new_lines); j++ {
+		result = append(result, "+ "+new_lines[j])
+	}
+
+	return result
+}
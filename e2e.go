@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Notes encrypted by the client start with this prefix, the rest is the
+// base64 of the nonce followed by the sealed text.
+const e2ePrefix = "e2e:v1:"
+
+// keyCheckText is encrypted with the key of a user when end-to-end
+// encryption is turned on, a passphrase is right when the result opens.
+const keyCheckText = "GoKeeper key check"
+
+// KeyCheck is what the server keeps about the key of a user: the salt to
+// derive it from the passphrase and keyCheckText encrypted with it.
+type KeyCheck struct {
+	UserId int    `db:"user_id" json:"-"`
+	Salt   string `db:"salt" json:"salt"`
+	Check  string `db:"key_check" json:"key_check"`
+	Titles bool   `db:"titles" json:"titles"`
+}
+
+// GetKeyCheck returns the key check of the user, an empty one when end-to-end
+// encryption is off.
+func (user *User) GetKeyCheck(db *sqlx.DB) (*KeyCheck, error) {
+	key := new(KeyCheck)
+
+	err := db.Get(key, "select * from user_keys where user_id=?", user.Id)
+	if err == sql.ErrNoRows {
+		return &KeyCheck{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (user *User) SetKeyCheck(db *sqlx.DB, key KeyCheck) error {
+	if key.Salt == "" || !strings.HasPrefix(key.Check, e2ePrefix) {
+		return fmt.Errorf("wrong key check")
+	}
+
+	current, err := user.GetKeyCheck(db)
+	if err != nil {
+		return err
+	}
+
+	if current.Salt != "" {
+		return fmt.Errorf("encryption is already turned on")
+	}
+
+	_, err = db.Exec("insert into user_keys (user_id, salt, key_check, titles) values (?, ?, ?, ?)",
+		user.Id, key.Salt, key.Check, key.Titles)
+	return err
+}
+
+// NoteCipher encrypts notes on the client, the server only sees the
+// ciphertext. Tags, notebooks and dates are not encrypted.
+type NoteCipher struct {
+	aead      cipher.AEAD
+	title_key []byte
+
+	// Titles is set when titles are encrypted too. They are encrypted
+	// deterministically so that the server can still tell equal titles
+	// apart in a notebook, which leaks which notes have the same title.
+	Titles bool
+
+	// Suspended turns encryption of new content off while working in a
+	// workspace, whose members don't have the key.
+	Suspended bool
+}
+
+// noteCipher is the cipher of the client session, nil when end-to-end
+// encryption is off.
+var noteCipher *NoteCipher
+
+func deriveNoteCipher(passphrase string, salt []byte, titles bool) (*NoteCipher, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, 3, 64*1024, 4, 2*chacha20poly1305.KeySize)
+
+	aead, err := chacha20poly1305.NewX(key[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &NoteCipher{aead: aead, title_key: key[chacha20poly1305.KeySize:], Titles: titles}, nil
+}
+
+// NewNoteCipher derives a key from passphrase with a new salt and returns
+// the key check to be stored on the server.
+func NewNoteCipher(passphrase string, titles bool) (*NoteCipher, *KeyCheck, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, nil, err
+	}
+
+	c, err := deriveNoteCipher(passphrase, salt, titles)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	check, err := c.Encrypt(keyCheckText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, &KeyCheck{Salt: base64.StdEncoding.EncodeToString(salt), Check: check, Titles: titles}, nil
+}
+
+// OpenNoteCipher derives the key from passphrase and checks it against key.
+func OpenNoteCipher(passphrase string, key KeyCheck) (*NoteCipher, error) {
+	salt, err := base64.StdEncoding.DecodeString(key.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := deriveNoteCipher(passphrase, salt, key.Titles)
+	if err != nil {
+		return nil, err
+	}
+
+	if text, err := c.Decrypt(key.Check); err != nil || text != keyCheckText {
+		return nil, fmt.Errorf("wrong passphrase")
+	}
+
+	return c, nil
+}
+
+// Active reports whether new content is encrypted.
+func (c *NoteCipher) Active() bool {
+	return c != nil && !c.Suspended
+}
+
+func (c *NoteCipher) seal(text string, nonce []byte) string {
+	sealed := c.aead.Seal(nonce, nonce, []byte(text), nil)
+	return e2ePrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func (c *NoteCipher) Encrypt(text string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return c.seal(text, nonce), nil
+}
+
+// EncryptTitle encrypts title when titles are encrypted, the same title
+// always gives the same ciphertext.
+func (c *NoteCipher) EncryptTitle(title string) string {
+	if !c.Titles {
+		return title
+	}
+
+	mac := hmac.New(sha256.New, c.title_key)
+	mac.Write([]byte(title))
+
+	return c.seal(title, mac.Sum(nil)[:c.aead.NonceSize()])
+}
+
+// Decrypt opens text encrypted by Encrypt or EncryptTitle, text without
+// the prefix was never encrypted and is returned as it is.
+func (c *NoteCipher) Decrypt(text string) (string, error) {
+	if !IsEncrypted(text) {
+		return text, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(text[len(e2ePrefix):])
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < c.aead.NonceSize() {
+		return "", fmt.Errorf("encrypted text is too short")
+	}
+
+	nonce := sealed[:c.aead.NonceSize()]
+	plain, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("can't decrypt note, it was encrypted with another key")
+	}
+
+	return string(plain), nil
+}
+
+// EncryptBytes encrypts binary data like attachments, the result is the
+// nonce followed by the sealed data.
+func (c *NoteCipher) EncryptBytes(data []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, data, nil), nil
+}
+
+func (c *NoteCipher) DecryptBytes(data []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is too short")
+	}
+
+	plain, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt attachment, it was encrypted with another key")
+	}
+
+	return plain, nil
+}
+
+// Overhead is how much longer EncryptBytes makes data.
+func (c *NoteCipher) Overhead() int {
+	return c.aead.NonceSize() + c.aead.Overhead()
+}
+
+func IsEncrypted(text string) bool {
+	return strings.HasPrefix(text, e2ePrefix)
+}
+
+// EncryptNote encrypts the title, query and items of note before it is sent to
+// the server, text which is already encrypted is left as it is.
+func (c *NoteCipher) EncryptNote(note *Note) error {
+	if !c.Active() {
+		return nil
+	}
+
+	if !IsEncrypted(note.Title) {
+		note.Title = c.EncryptTitle(note.Title)
+	}
+
+	if !IsEncrypted(note.Data) {
+		data, err := c.Encrypt(note.Data)
+		if err != nil {
+			return err
+		}
+		note.Data = data
+	}
+
+	for i := range note.Items {
+		if !IsEncrypted(note.Items[i].Text) {
+			text, err := c.Encrypt(note.Items[i].Text)
+			if err != nil {
+				return err
+			}
+			note.Items[i].Text = text
+		}
+	}
+
+	return nil
+}
+
+// DecryptNotes decrypts notes received from the server. Notes encrypted
+// with another key, like ones shared by other users, keep their ciphertext.
+func (c *NoteCipher) DecryptNotes(notes []Note) {
+	if c == nil {
+		return
+	}
+
+	for i := range notes {
+		c.DecryptNote(&notes[i])
+	}
+}
+
+func (c *NoteCipher) DecryptNote(note *Note) {
+	if c == nil {
+		return
+	}
+
+	if title, err := c.Decrypt(note.Title); err == nil {
+		note.Title = title
+	}
+
+	if data, err := c.Decrypt(note.Data); err == nil {
+		note.Data = data
+	}
+
+	c.DecryptItems(note.Items)
+}
+
+func (c *NoteCipher) DecryptItems(items []ChecklistItem) {
+	if c == nil {
+		return
+	}
+
+	for i := range items {
+		if text, err := c.Decrypt(items[i].Text); err == nil {
+			items[i].Text = text
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ExportPageSize is about the most bytes of notes sent in one export page,
+// a larger note is sent alone.
+const ExportPageSize = 256 * 1024
+
+// exportBatch is how many notes are read at a time for an export page.
+const exportBatch = 100
+
+// ExportFormats are the formats notes can be exported to, md is a
+// directory of Markdown files.
+var ExportFormats = []string{"json", "md", "csv"}
+
+// exportScope returns the condition selecting the personal notes of the
+// user and the notes of the workspaces they may read.
+func (user *User) exportScope(db *sqlx.DB) (string, []interface{}, error) {
+	workspace_ids := make([]int, 0)
+	err := db.Select(&workspace_ids, "select workspace_id from workspace_members where user_id=? order by workspace_id",
+		user.Id)
+	if err != nil {
+		return "", nil, err
+	}
+
+	where, args := Scope{UserId: user.Id}.Where("")
+	conditions := []string{"(" + where + ")"}
+
+	for i := range workspace_ids {
+		has, err := user.workspacePermission(db, workspace_ids[i])
+		if err != nil {
+			return "", nil, err
+		}
+
+		if has < PermRead {
+			continue
+		}
+
+		where, workspace_args := Scope{UserId: user.Id, WorkspaceId: &workspace_ids[i]}.Where("")
+		conditions = append(conditions, "("+where+")")
+		args = append(args, workspace_args...)
+	}
+
+	return "(" + strings.Join(conditions, " or ") + ")", args, nil
+}
+
+// ExportNotes returns the personal notes of the user and the notes of the
+// workspaces they are a member of with ids after after, as many as fit in
+// ExportPageSize, and the id to continue after, which is 0 when there are
+// no more notes. Notes in the trash are left out.
+func (user *User) ExportNotes(db *sqlx.DB, after int) ([]Note, int, error) {
+	scope, args, err := user.exportScope(db)
+	if err != nil {
+		return nil, 0, err
+	}
+	args = append(args, after, exportBatch+1)
+
+	notes := make([]Note, 0, exportBatch+1)
+	err = db.Select(&notes, "select * from notes where "+scope+
+		" and deleted_at is null and id>? order by id limit ?", args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	more := len(notes) > exportBatch
+	if more {
+		notes = notes[:exportBatch]
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, 0, err
+	}
+
+	size := 0
+	for i := range notes {
+		note_size := NoteSize(&notes[i])
+		for _, item := range notes[i].Items {
+			note_size += len(item.Text)
+		}
+
+		if i > 0 && size+note_size > ExportPageSize {
+			notes, more = notes[:i], true
+			break
+		}
+		size += note_size
+	}
+
+	if !more || len(notes) == 0 {
+		return notes, 0, nil
+	}
+
+	return notes, notes[len(notes)-1].Id, nil
+}
+
+// noteExporter writes exported notes one at a time, Abort removes what
+// was written.
+type noteExporter interface {
+	Write(note *Note) error
+	Close() error
+	Abort()
+}
+
+// NewNoteExporter creates the file or, for md, the directory at path to
+// export notes in format to, existing ones are not overwritten.
+func NewNoteExporter(format, path string) (noteExporter, error) {
+	switch format {
+	case "json":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter := &jsonExporter{f: f, w: bufio.NewWriter(f)}
+		fmt.Fprintf(exporter.w, "{\"exported_at\":\"%s\",\"notes\":[", time.Now().UTC().Format(time.RFC3339))
+		return exporter, nil
+	case "md":
+		if err := os.Mkdir(path, 0700); err != nil {
+			return nil, err
+		}
+
+		return &markdownExporter{dir: path}, nil
+	case "csv":
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		exporter := &csvExporter{f: f, w: csv.NewWriter(f)}
+		exporter.w.Write([]string{"id", "title", "kind", "language", "notebook", "tags", "pinned", "favorite",
+			"created", "updated", "query", "items"})
+		return exporter, nil
+	}
+
+	return nil, fmt.Errorf("unknown export format \"%s\", use %s", format, strings.Join(ExportFormats, ", "))
+}
+
+// jsonExporter writes an object with the time of the export and an array
+// of the notes as the server sends them.
+type jsonExporter struct {
+	f     *os.File
+	w     *bufio.Writer
+	count int
+}
+
+func (e *jsonExporter) Write(note *Note) error {
+	data, err := json.Marshal(note)
+	if err != nil {
+		return err
+	}
+
+	if e.count > 0 {
+		e.w.WriteByte(',')
+	}
+	e.count++
+
+	e.w.WriteString("\n")
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *jsonExporter) Close() error {
+	e.w.WriteString("\n]}\n")
+	if err := e.w.Flush(); err != nil {
+		e.f.Close()
+		return err
+	}
+
+	return e.f.Close()
+}
+
+func (e *jsonExporter) Abort() {
+	e.f.Close()
+	os.Remove(e.f.Name())
+}
+
+// markdownExporter writes every note to a file named after its id and
+// title with the metadata in YAML front matter.
+type markdownExporter struct {
+	dir string
+}
+
+// exportFileName is the id of note followed by its title reduced to
+// lowercase letters, digits and dashes.
+func exportFileName(note *Note) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(note.Title) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+
+		if b.Len() >= 60 {
+			break
+		}
+	}
+
+	if b.Len() == 0 {
+		return fmt.Sprintf("%d.md", note.Id)
+	}
+	return fmt.Sprintf("%d-%s.md", note.Id, b.String())
+}
+
+// yamlString quotes s as a YAML string, JSON strings are valid YAML.
+func yamlString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+// codeFence returns a fence of backticks longer than any run of them in
+// text.
+func codeFence(text string) string {
+	longest, run := 0, 0
+	for _, r := range text {
+		if r == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+
+	if longest < 3 {
+		return "```"
+	}
+	return strings.Repeat("`", longest+1)
+}
+
+func (e *markdownExporter) Write(note *Note) error {
+	var b strings.Builder
+
+	tags := make([]string, len(note.Tags))
+	for i, tag := range note.Tags {
+		tags[i] = yamlString(tag)
+	}
+
+	b.WriteString("---\n")
+	fmt.Fprintf(&b, "id: %d\n", note.Id)
+	fmt.Fprintf(&b, "title: %s\n", yamlString(note.Title))
+	fmt.Fprintf(&b, "kind: %s\n", yamlString(note.Kind))
+	if note.Language != "" {
+		fmt.Fprintf(&b, "language: %s\n", yamlString(note.Language))
+	}
+	fmt.Fprintf(&b, "tags: [%s]\n", strings.Join(tags, ", "))
+	if note.Notebook != "" {
+		fmt.Fprintf(&b, "notebook: %s\n", yamlString(note.Notebook))
+	}
+	fmt.Fprintf(&b, "pinned: %t\n", note.Pinned)
+	fmt.Fprintf(&b, "favorite: %t\n", note.Favorite)
+	fmt.Fprintf(&b, "created: %s\n", note.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "updated: %s\n", note.UpdatedAt.UTC().Format(time.RFC3339))
+	b.WriteString("---\n\n")
+
+	if note.Data != "" {
+		if note.Language != "" {
+			fence := codeFence(note.Data)
+			fmt.Fprintf(&b, "%s%s\n%s\n%s\n", fence, note.Language, strings.TrimSuffix(note.Data, "\n"), fence)
+		} else {
+			b.WriteString(strings.TrimSuffix(note.Data, "\n") + "\n")
+		}
+	}
+
+	if len(note.Items) > 0 {
+		if note.Data != "" {
+			b.WriteString("\n")
+		}
+
+		for _, item := range note.Items {
+			mark := " "
+			if item.Checked {
+				mark = "x"
+			}
+			fmt.Fprintf(&b, "- [%s] %s\n", mark, item.Text)
+		}
+	}
+
+	path := filepath.Join(e.dir, exportFileName(note))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (e *markdownExporter) Close() error {
+	return nil
+}
+
+// Abort removes the directory, it was created by the export.
+func (e *markdownExporter) Abort() {
+	os.RemoveAll(e.dir)
+}
+
+// csvExporter writes a row per note, tags are separated by commas and
+// items by new lines.
+type csvExporter struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func (e *csvExporter) Write(note *Note) error {
+	items := make([]string, len(note.Items))
+	for i, item := range note.Items {
+		mark := " "
+		if item.Checked {
+			mark = "x"
+		}
+		items[i] = fmt.Sprintf("[%s] %s", mark, item.Text)
+	}
+
+	return e.w.Write([]string{
+		strconv.Itoa(note.Id),
+		note.Title,
+		note.Kind,
+		note.Language,
+		note.Notebook,
+		strings.Join(note.Tags, ","),
+		strconv.FormatBool(note.Pinned),
+		strconv.FormatBool(note.Favorite),
+		note.CreatedAt.UTC().Format(time.RFC3339),
+		note.UpdatedAt.UTC().Format(time.RFC3339),
+		note.Data,
+		strings.Join(items, "\n"),
+	})
+}
+
+func (e *csvExporter) Close() error {
+	e.w.Flush()
+	if err := e.w.Error(); err != nil {
+		e.f.Close()
+		return err
+	}
+
+	return e.f.Close()
+}
+
+func (e *csvExporter) Abort() {
+	e.f.Close()
+	os.Remove(e.f.Name())
+}
@@ -0,0 +1,8 @@
+//go:build sqlite_fts5
+// +build sqlite_fts5
+
+package main
+
+// FullTextSearch is set when the sqlite driver is built with FTS5, build
+// with -tags sqlite_fts5 to enable it.
+const FullTextSearch = true
@@ -0,0 +1,6 @@
+//go:build !sqlite_fts5
+// +build !sqlite_fts5
+
+package main
+
+const FullTextSearch = false
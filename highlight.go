@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ANSI colors of highlighted code
+const (
+	colorReset    = "\033[0m"
+	colorKeyword  = "\033[1;34m"
+	colorString   = "\033[32m"
+	colorComment  = "\033[90m"
+	colorNumber   = "\033[35m"
+	colorKey      = "\033[36m"
+	colorVariable = "\033[33m"
+)
+
+// syntax describes a language well enough to color its tokens, it is not
+// a parser and doesn't have to understand every corner of the language.
+type syntax struct {
+	lineComments []string
+	blockComment [2]string
+	quotes       string
+	keywords     map[string]bool
+	ignoreCase   bool
+
+	// variables start with $ like in shell
+	variables bool
+	// keys are words or strings followed by a colon like in JSON and YAML
+	keys bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, word := range strings.Fields(words) {
+		set[word] = true
+	}
+
+	return set
+}
+
+var syntaxes = map[string]*syntax{
+	"sql": {
+		lineComments: []string{"--"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "'\"",
+		ignoreCase:   true,
+		keywords: keywordSet(`select from where and or not in is null like between join left right inner outer
+			full cross on as group by order having limit offset insert into values update set delete create
+			table index view drop alter add column primary key foreign references unique default distinct
+			union all case when then else end exists with recursive asc desc count sum avg min max begin
+			commit rollback true false`),
+	},
+	"shell": {
+		lineComments: []string{"#"},
+		quotes:       "'\"",
+		variables:    true,
+		keywords: keywordSet(`if then else elif fi for in do done while until case esac function return
+			local export readonly shift exit break continue echo cd source set unset`),
+	},
+	"go": {
+		lineComments: []string{"//"},
+		blockComment: [2]string{"/*", "*/"},
+		quotes:       "\"'`",
+		keywords: keywordSet(`break case chan const continue default defer else fallthrough for func go goto
+			if import interface map package range return select struct switch type var nil true false
+			bool byte error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16
+			uint32 uint64 uintptr append cap close copy delete len make new panic print println recover`),
+	},
+	"json": {
+		quotes:   "\"",
+		keys:     true,
+		keywords: keywordSet("true false null"),
+	},
+	"yaml": {
+		lineComments: []string{"#"},
+		quotes:       "'\"",
+		keys:         true,
+		keywords:     keywordSet("true false null yes no on off"),
+	},
+}
+
+// Languages maps the names a language can be given to the name it is
+// stored with.
+var Languages = map[string]string{
+	"sql":        "sql",
+	"sqlite":     "sql",
+	"postgres":   "sql",
+	"mysql":      "sql",
+	"shell":      "shell",
+	"sh":         "shell",
+	"bash":       "shell",
+	"zsh":        "shell",
+	"go":         "go",
+	"golang":     "go",
+	"json":       "json",
+	"yaml":       "yaml",
+	"yml":        "yaml",
+	"python":     "python",
+	"javascript": "javascript",
+	"js":         "javascript",
+	"text":       "",
+	"none":       "",
+}
+
+// HighlightCode colors text written in lang with ANSI escapes, text in
+// languages without a syntax is returned as it is.
+func HighlightCode(text, lang string) string {
+	syn, ok := syntaxes[lang]
+	if !ok {
+		return text
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		n, color := syn.token(text, i)
+		if color == "" {
+			b.WriteString(text[i : i+n])
+		} else {
+			b.WriteString(color + text[i:i+n] + colorReset)
+		}
+		i += n
+	}
+
+	return b.String()
+}
+
+// token returns the length and the color of the token at i.
+func (syn *syntax) token(text string, i int) (int, string) {
+	rest := text[i:]
+
+	for _, prefix := range syn.lineComments {
+		// a # inside a word like in a URL is not a comment
+		if strings.HasPrefix(rest, prefix) && (prefix != "#" || i == 0 || isSpace(text[i-1])) {
+			return lineEnd(rest), colorComment
+		}
+	}
+
+	if open := syn.blockComment[0]; open != "" && strings.HasPrefix(rest, open) {
+		end := strings.Index(rest[len(open):], syn.blockComment[1])
+		if end < 0 {
+			return len(rest), colorComment
+		}
+		return len(open) + end + len(syn.blockComment[1]), colorComment
+	}
+
+	c := rest[0]
+	switch {
+	case strings.IndexByte(syn.quotes, c) >= 0:
+		n := quotedLen(rest)
+		if syn.keys && isKey(rest[n:]) {
+			return n, colorKey
+		}
+		return n, colorString
+	case syn.variables && c == '$' && len(rest) > 1:
+		if rest[1] == '{' {
+			if end := strings.IndexByte(rest, '}'); end > 0 {
+				return end + 1, colorVariable
+			}
+		}
+		n := 1 + wordLen(rest[1:])
+		if n == 1 {
+			return 1, ""
+		}
+		return n, colorVariable
+	case c >= '0' && c <= '9' || c == '-' && len(rest) > 1 && rest[1] >= '0' && rest[1] <= '9' && !syn.variables:
+		if i > 0 && isWordChar(text[i-1]) {
+			return 1, ""
+		}
+		return numberLen(rest), colorNumber
+	case isWordChar(c):
+		n := wordLen(rest)
+		if i > 0 && isWordChar(text[i-1]) {
+			return n, ""
+		}
+
+		word := rest[:n]
+		if syn.keys && isKey(rest[n:]) {
+			return n, colorKey
+		}
+
+		if syn.ignoreCase {
+			word = strings.ToLower(word)
+		}
+		if syn.keywords[word] {
+			return n, colorKeyword
+		}
+		return n, ""
+	}
+
+	return 1, ""
+}
+
+func lineEnd(text string) int {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return i
+	}
+
+	return len(text)
+}
+
+// quotedLen returns the length of the string starting with a quote,
+// an unterminated string ends with the line.
+func quotedLen(text string) int {
+	quote := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case text[i] == '\\' && quote != '`' && quote != '\'':
+			i++
+		case text[i] == quote:
+			return i + 1
+		case text[i] == '\n' && quote != '`':
+			return i
+		}
+	}
+
+	return len(text)
+}
+
+func isKey(after string) bool {
+	after = strings.TrimLeft(after, " \t")
+	return strings.HasPrefix(after, ":") && (len(after) == 1 || isSpace(after[1]) || after[1] == '"')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c >= 0x80
+}
+
+func wordLen(text string) int {
+	n := 0
+	for n < len(text) && isWordChar(text[n]) {
+		n++
+	}
+
+	return n
+}
+
+func numberLen(text string) int {
+	n := 1
+	for n < len(text) && (isWordChar(text[n]) || text[n] == '.') {
+		n++
+	}
+
+	return n
+}
+
+// NormalizeLanguage returns the name lang is stored with, names without
+// an alias are kept when they look like a language name.
+func NormalizeLanguage(lang string) (string, error) {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if name, ok := Languages[lang]; ok {
+		return name, nil
+	}
+
+	if lang == "" || len(lang) > 20 {
+		return "", fmt.Errorf("wrong language \"%s\"", lang)
+	}
+
+	for i := 0; i < len(lang); i++ {
+		if !(lang[i] >= 'a' && lang[i] <= 'z' || lang[i] >= '0' && lang[i] <= '9' || strings.IndexByte("+#-", lang[i]) >= 0) {
+			return "", fmt.Errorf("wrong language \"%s\"", lang)
+		}
+	}
+
+	return lang, nil
+}
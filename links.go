@@ -0,0 +1,300 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Queries link to other notes of their scope with [[Title]] or [[#id]].
+// Links are extracted by the server when a note is written, so notes
+// encrypted end-to-end have none.
+var linkRe = regexp.MustCompile(`\[\[([^\[\]\n]+)\]\]`)
+
+// NoteLink is a link in the query of the note with NoteId. TargetId is the
+// note it points to, nil while no note of the scope has the linked title.
+type NoteLink struct {
+	Id       int    `db:"id" json:"-"`
+	NoteId   int    `db:"note_id" json:"note_id"`
+	Position int    `db:"position" json:"-"`
+	Target   string `db:"target" json:"target"`
+	ById     bool   `db:"by_id" json:"by_id"`
+	TargetId *int   `db:"target_id" json:"target_id,omitempty"`
+
+	// Title is the title of the target note if the user can read it.
+	Title string `db:"-" json:"title,omitempty"`
+}
+
+// ExtractLinks returns the targets of links in text in the order they
+// first appear, targets differing only in case are the same.
+func ExtractLinks(text string) []string {
+	seen := make(map[string]bool)
+	targets := make([]string, 0)
+
+	for _, match := range linkRe.FindAllStringSubmatch(text, -1) {
+		target := strings.TrimSpace(match[1])
+		if target == "" || seen[strings.ToLower(target)] {
+			continue
+		}
+
+		seen[strings.ToLower(target)] = true
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// linkId returns the note id of a [[#id]] link target.
+func linkId(target string) (int, bool) {
+	if !strings.HasPrefix(target, "#") {
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(target[1:])
+	return id, err == nil && id > 0
+}
+
+// RewriteLinkTitle replaces links to old_title in text with links to
+// new_title.
+func RewriteLinkTitle(text, old_title, new_title string) string {
+	return linkRe.ReplaceAllStringFunc(text, func(link string) string {
+		target := strings.TrimSpace(linkRe.FindStringSubmatch(link)[1])
+		if _, ok := linkId(target); ok || !strings.EqualFold(target, old_title) {
+			return link
+		}
+
+		return "[[" + new_title + "]]"
+	})
+}
+
+// scopeTitles maps lower case titles of notes of the scope outside of the
+// trash to the oldest note with that title. Only titles are read, queries
+// are neither loaded nor decrypted.
+func scopeTitles(db sqlx.Ext, scope Scope) (map[string]int, error) {
+	where, args := scope.Where("")
+	notes := make([]Note, 0)
+	err := sqlx.Select(db, &notes, "select id, user_id, title from notes where "+where+
+		" and deleted_at is null order by id desc", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	titles := make(map[string]int, len(notes))
+	for _, note := range notes {
+		title, err := atRest.OpenText(db, note.UserId, note.Title)
+		if err != nil {
+			return nil, err
+		}
+		titles[strings.ToLower(title)] = note.Id
+	}
+
+	return titles, nil
+}
+
+// saveNoteLinks replaces the links of note with the ones in its query,
+// note must not be encrypted at rest.
+func saveNoteLinks(tx *sqlx.Tx, note *Note) error {
+	if _, err := tx.Exec("delete from note_links where note_id=?", note.Id); err != nil {
+		return err
+	}
+
+	var titles map[string]int
+	for i, target := range ExtractLinks(note.Data) {
+		link := NoteLink{NoteId: note.Id, Position: i}
+
+		if id, ok := linkId(target); ok {
+			link.ById = true
+			link.TargetId = &id
+		} else {
+			if titles == nil {
+				var err error
+				if titles, err = scopeTitles(tx, NoteScope(note)); err != nil {
+					return err
+				}
+			}
+
+			if id, ok := titles[strings.ToLower(target)]; ok {
+				link.TargetId = &id
+			}
+		}
+
+		var err error
+		if link.Target, err = atRest.SealText(tx, note.UserId, target); err != nil {
+			return err
+		}
+
+		_, err = tx.NamedExec(`insert into note_links (note_id, position, target, by_id, target_id)
+			values (:note_id, :position, :target, :by_id, :target_id)`, link)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resolveLinks points links of the scope which don't point to any note to
+// the note with their title if there is one now.
+func resolveLinks(tx *sqlx.Tx, scope Scope) error {
+	type dangling struct {
+		NoteLink
+		UserId int `db:"user_id"`
+	}
+
+	where, args := scope.Where("n.")
+	links := make([]dangling, 0)
+	err := tx.Select(&links, `select l.*, n.user_id from note_links l join notes n on n.id=l.note_id
+		where `+where+` and l.target_id is null and l.by_id=0`, args...)
+	if err != nil || len(links) == 0 {
+		return err
+	}
+
+	titles, err := scopeTitles(tx, scope)
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		target, err := atRest.OpenText(tx, link.UserId, link.Target)
+		if err != nil {
+			return err
+		}
+
+		if id, ok := titles[strings.ToLower(target)]; ok {
+			if _, err = tx.Exec("update note_links set target_id=? where id=?", id, link.Id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// relinkRenamed updates links after the title of note changed from
+// old_title. Links by title to the note are rewritten to the new title in
+// the notes the user may write when rewrite is set, the others no longer
+// point to it.
+func (user *User) relinkRenamed(tx *sqlx.Tx, note *Note, old_title string, rewrite bool) error {
+	sources := make([]Note, 0)
+	if rewrite {
+		err := tx.Select(&sources, `select * from notes where deleted_at is null and id<>? and id in
+			(select note_id from note_links where target_id=? and by_id=0)`, note.Id, note.Id)
+		if err != nil {
+			return err
+		}
+
+		if err = OpenNotes(tx, sources); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("update note_links set target_id=null where target_id=? and by_id=0", note.Id); err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		has, err := user.NotePermission(tx, &source)
+		if err != nil {
+			return err
+		}
+
+		data := RewriteLinkTitle(source.Data, old_title, note.Title)
+		if has < PermWrite || data == source.Data {
+			continue
+		}
+		source.Data = data
+
+		sealed := source
+		if err = SealNote(tx, &sealed); err != nil {
+			return err
+		}
+
+		if err = putNoteBody(tx, &sealed); err != nil {
+			return err
+		}
+
+		_, err = tx.NamedExec(`update notes set data_text=:data_text, body_blob=:body_blob, updated_at=CURRENT_TIMESTAMP,
+			version=version+1 where id=:id`, sealed)
+		if err != nil {
+			return err
+		}
+
+		if err = releaseNoteBody(tx, &source); err != nil {
+			return err
+		}
+
+		if err = saveNoteLinks(tx, &source); err != nil {
+			return err
+		}
+	}
+
+	return resolveLinks(tx, NoteScope(note))
+}
+
+// GetNoteLinks returns the links of a note the user can read, links to
+// notes the user can't read don't show their target.
+func (user *User) GetNoteLinks(db *sqlx.DB, note_id int) ([]NoteLink, error) {
+	note, err := user.GetNoteById(db, note_id)
+	if err != nil {
+		return nil, err
+	}
+
+	links := make([]NoteLink, 0)
+	if err = db.Select(&links, "select * from note_links where note_id=? order by position", note.Id); err != nil {
+		return nil, err
+	}
+
+	for i := range links {
+		if links[i].Target, err = atRest.OpenText(db, note.UserId, links[i].Target); err != nil {
+			return nil, err
+		}
+
+		if links[i].TargetId == nil {
+			continue
+		}
+
+		target, err := user.GetNoteById(db, *links[i].TargetId)
+		if err != nil {
+			links[i].TargetId = nil
+			continue
+		}
+		links[i].Title = target.Title
+	}
+
+	return links, nil
+}
+
+// GetBacklinks returns the notes the user can read which link to a note.
+func (user *User) GetBacklinks(db *sqlx.DB, note_id int) ([]Note, error) {
+	note, err := user.GetNoteById(db, note_id)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]Note, 0)
+	err = db.Select(&notes, `select * from notes where deleted_at is null and id in
+		(select note_id from note_links where target_id=?) order by id`, note.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	readable := notes[:0]
+	for _, source := range notes {
+		has, err := user.NotePermission(db, &source)
+		if err != nil {
+			return nil, err
+		}
+
+		if has >= PermRead {
+			readable = append(readable, source)
+		}
+	}
+
+	if err = user.LoadNoteDetails(db, readable); err != nil {
+		return nil, err
+	}
+
+	return readable, nil
+}
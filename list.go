@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ListOptions are how notes in list and search responses are sorted and
+// which of their fields are sent. Sort is one of id, title, created and
+// updated, pinned notes come first either way. Fields empty sends all of
+// them, otherwise id, version and flags are always sent.
+type ListOptions struct {
+	Sort   string   `json:"sort,omitempty"`
+	Desc   bool     `json:"desc,omitempty"`
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ListFields are the fields which can be asked for, body is the query.
+var ListFields = []string{"title", "body", "kind", "language", "tags", "notebook", "items", "created", "updated"}
+
+func (opts ListOptions) Check() error {
+	switch opts.Sort {
+	case "", "id", "title", "created", "updated":
+	default:
+		return fmt.Errorf("can't sort by \"%s\", use id, title, created or updated", opts.Sort)
+	}
+
+	for _, field := range opts.Fields {
+		if !contains(ListFields, field) {
+			return fmt.Errorf("unknown field \"%s\", use %s", field, strings.Join(ListFields, ", "))
+		}
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (opts ListOptions) hasField(field string) bool {
+	return len(opts.Fields) == 0 || contains(opts.Fields, field)
+}
+
+// lessNote orders a before b by field, titles ignore case and ties are
+// broken by id.
+func lessNote(a, b *Note, field string, desc bool) bool {
+	if a.Pinned != b.Pinned {
+		return a.Pinned
+	}
+
+	var less, equal bool
+	switch field {
+	case "title":
+		x, y := strings.ToLower(a.Title), strings.ToLower(b.Title)
+		less, equal = x < y, x == y
+	case "created":
+		less, equal = a.CreatedAt.Before(b.CreatedAt), a.CreatedAt.Equal(b.CreatedAt)
+	case "updated":
+		less, equal = a.UpdatedAt.Before(b.UpdatedAt), a.UpdatedAt.Equal(b.UpdatedAt)
+	default:
+		less, equal = a.Id < b.Id, a.Id == b.Id
+	}
+
+	if equal {
+		less = a.Id < b.Id
+	}
+
+	if desc {
+		return !less && a.Id != b.Id
+	}
+	return less
+}
+
+// SortNotes sorts notes by opts.Sort, without it they stay as they are.
+func SortNotes(notes []Note, opts ListOptions) {
+	if opts.Sort == "" {
+		return
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool { return lessNote(&notes[i], &notes[j], opts.Sort, opts.Desc) })
+}
+
+// SortSearchResults sorts results by opts.Sort, without it they stay
+// ordered by rank.
+func SortSearchResults(results []SearchResult, opts ListOptions) {
+	if opts.Sort == "" {
+		return
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return lessNote(&results[i].Note, &results[j].Note, opts.Sort, opts.Desc)
+	})
+}
+
+// ProjectNote clears the fields of note which were not asked for.
+func (opts ListOptions) ProjectNote(note *Note) {
+	if len(opts.Fields) == 0 {
+		return
+	}
+
+	if !opts.hasField("title") {
+		note.Title = ""
+	}
+	if !opts.hasField("body") {
+		note.Data = ""
+	}
+	if !opts.hasField("kind") {
+		note.Kind = ""
+	}
+	if !opts.hasField("language") {
+		note.Language = ""
+	}
+	if !opts.hasField("tags") {
+		note.Tags = nil
+	}
+	if !opts.hasField("notebook") {
+		note.Notebook, note.NotebookId = "", nil
+	}
+	if !opts.hasField("items") {
+		note.Items = nil
+	}
+	if !opts.hasField("created") {
+		note.CreatedAt = time.Time{}
+	}
+	if !opts.hasField("updated") {
+		note.UpdatedAt = time.Time{}
+	}
+}
+
+func (opts ListOptions) ProjectNotes(notes []Note) {
+	for i := range notes {
+		opts.ProjectNote(&notes[i])
+	}
+}
+
+// noteColumns are the columns of notes to select for opts, the query is
+// only read when it is asked for.
+func (opts ListOptions) noteColumns(prefix string) string {
+	if opts.hasField("body") {
+		return prefix + "*"
+	}
+
+	columns := []string{"id", "user_id", "title", "deleted_at", "notebook_id", "created_at", "updated_at",
+		"version", "workspace_id", "kind", "language", "pinned"}
+	for i := range columns {
+		columns[i] = prefix + columns[i]
+	}
+
+	return strings.Join(columns, ", ")
+}
@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
 func main() {
@@ -16,17 +21,35 @@ func main() {
 
 	switch os.Args[1] {
 	case "-s":
-		db, err := CreateConn("sqlite3", "notes.db")
+		f, err := GetConfigFileData("config.json")
+
 		if err != nil {
 			log.Fatalln(err)
 		}
-		defer db.Close()
 
-		f, err := GetConfigFileData("config.json")
+		if err = SetupAtRest(f.MasterKeyFile); err != nil {
+			log.Fatalln(err)
+		}
 
+		db, err := CreateConn("sqlite3", "notes.db")
 		if err != nil {
 			log.Fatalln(err)
 		}
+		defer db.Close()
+
+		if err = CheckAtRestKeys(db); err != nil {
+			log.Fatalln(err)
+		}
+
+		if f.MaxAttachmentSize > 0 {
+			maxAttachmentSize = f.MaxAttachmentSize
+		}
+		quotas = f.Quotas
+
+		if f.TrashMaxDays > 0 {
+			go StartTrashPurger(db, time.Duration(f.TrashMaxDays)*24*time.Hour)
+		}
+		go StartScheduler(db)
 
 		StartRoutineServer(f.Host, f.Port, int(f.MaxConn), db)
 	case "-c":
@@ -47,7 +70,7 @@ func main() {
 				ClientErrorMsg(err)
 			}
 
-			MsgManager(conn)
+			MsgManager(conn, f, user.UserName)
 		}
 
 		if os.Args[2] == "-r" {
@@ -58,10 +81,45 @@ func main() {
 				ClientErrorMsg(err)
 			}
 
-			MsgManager(conn)
+			MsgManager(conn, f, user.UserName)
 		}
 
 		ClientErrorMsg(fmt.Errorf("unknown flag of auth type"))
+	case "-keygen":
+		if len(os.Args) < 3 {
+			log.Fatalln("enter the file for the new master key (./GoKeeper -keygen master.key)")
+		}
+
+		if err := GenerateMasterKey(os.Args[2]); err != nil {
+			log.Fatalln(err)
+		}
+	case "-rotate-key":
+		if len(os.Args) < 3 {
+			log.Fatalln("enter the file with the new master key (./GoKeeper -rotate-key new.key), stop the server first")
+		}
+
+		if err := RotateKeyCommand(os.Args[2]); err != nil {
+			log.Fatalln(err)
+		}
+
+		fmt.Println("notes are encrypted with the new key, set master_key_file in config.json to it")
+	case "-gc":
+		db, err := CreateConn("sqlite3", "notes.db")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer db.Close()
+
+		count, size, err := CollectGarbage(db)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		if _, err = db.Exec("vacuum"); err != nil {
+			log.Fatalln(err)
+		}
+
+		fmt.Printf("%d unused blobs removed, %d bytes freed\n", count, size)
 	case "--help":
 		fmt.Println("enter after bin name and mode flag auth mode and user name with password (./GoKeeper -c -a login password)")
 		os.Exit(1)
@@ -76,34 +134,138 @@ func ClientErrorMsg(err error) {
 	os.Exit(1)
 }
 
-func ScanString(text string) (string, error) {
-	reader := bufio.NewReader(os.Stdin)
+// stdin is shared by all prompts so that input buffered by one read isn't
+// lost for the next one.
+var stdin = bufio.NewReader(os.Stdin)
 
+func ScanString(text string) (string, error) {
 	fmt.Print(text)
-	message, err := reader.ReadString('\n')
+	message, err := stdin.ReadString('\n')
 	if err != nil {
 		return "", err
 	}
 
-	return message[:len(message)-2], nil
+	return strings.TrimRight(message, "\r\n"), nil
+}
+
+// Confirm asks a yes/no question and reports whether the answer was yes.
+func Confirm(text string) bool {
+	answer, err := ScanString(text + " (y/n): ")
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func ScanInt(text string) (int, error) {
+	str, err := ScanString(text)
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	return strconv.Atoi(strings.TrimSpace(str))
+}
+
+// ScanList reads a comma separated list, an empty answer gives nil.
+func ScanList(text string) []string {
+	str, err := ScanString(text)
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if strings.TrimSpace(str) == "" {
+		return nil
+	}
+
+	return strings.Split(str, ",")
 }
 
 func (note *Note) ViewNote() {
-	fmt.Printf("id: %d\ntitle: %s\n", note.Id, note.Title)
-	fmt.Printf("query: %s\n", note.Data)
+	title, data := note.Title, note.Data
+	if IsEncrypted(title) {
+		title = "(encrypted)"
+	}
+	if IsEncrypted(data) {
+		data = "(encrypted)"
+	}
+
+	if note.Kind == NoteSecret && data != "(encrypted)" {
+		data = "******** (enter reveal to show)"
+	}
+
+	fmt.Printf("id: %d\ntitle: %s\n", note.Id, title)
+	if note.Pinned || note.Favorite {
+		flags := make([]string, 0, 2)
+		if note.Pinned {
+			flags = append(flags, "pinned")
+		}
+		if note.Favorite {
+			flags = append(flags, "favorite")
+		}
+		fmt.Printf("flags: %s\n", strings.Join(flags, ", "))
+	}
+	if note.Kind != "" && note.Kind != NotePlain {
+		fmt.Printf("kind: %s\n", note.Kind)
+	}
+	if note.Language != "" {
+		fmt.Printf("language: %s\n", note.Language)
+	}
+	if note.Kind == NoteChecklist {
+		done, total := ChecklistProgress(note.Items)
+		fmt.Printf("progress: %d/%d\n", done, total)
+		PrintChecklist(note.Items)
+	}
+
+	// highlighting starts the query on a line of its own so that its lines
+	// are aligned
+	if note.Language != "" && data == note.Data && IsTerminal() {
+		fmt.Printf("query:\n%s\n", HighlightCode(data, note.Language))
+	} else if note.Kind != NoteChecklist || data != "" {
+		fmt.Printf("query: %s\n", data)
+	}
+	if note.Notebook != "" {
+		fmt.Printf("notebook: %s\n", note.Notebook)
+	}
+	if len(note.Tags) > 0 {
+		fmt.Printf("tags: %s\n", strings.Join(note.Tags, ", "))
+	}
+	if !note.UpdatedAt.IsZero() {
+		fmt.Printf("updated: %s\n", note.UpdatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	if note.DeletedAt != nil {
+		fmt.Printf("deleted: %s\n", note.DeletedAt.Local().Format("2006-01-02 15:04"))
+	}
 }
 
-func MsgManager(conn net.Conn) {
+func MsgManager(conn net.Conn, config *ConfigFile, user_name string) {
 	var str string
 	var err error
 	var note Note
+	var workspace string
+
+	if err = UnlockNotes(conn); err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if c, ok := conn.(*MessageConn); ok {
+		go ShowNotifications(c.Notifications())
+	}
 
 	for {
-		str, err = ScanString(">>> ")
+		prompt := ">>> "
+		if workspace != "" {
+			prompt = "[" + workspace + "] >>> "
+		}
+
+		str, err = ScanString(prompt)
 		if err != nil {
 			ClientErrorMsg(err)
 		}
 
+		args := strings.Fields(str)
+
 		switch str {
 		case "add":
 
@@ -113,18 +275,121 @@ func MsgManager(conn net.Conn) {
 			}
 			note.Title = str
 
-			str, err = ScanString("enter query: ")
+			if note.Kind, err = ScanString("enter kind (plain/secret/snippet/template/checklist, empty for plain): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if note.Kind == NoteSecret {
+				str, err = ScanString("enter query (empty to generate a password): ")
+			} else if note.Kind == NoteChecklist {
+				str, err = ScanString("enter description (empty for none): ")
+			} else {
+				str, err = ScanString("enter query: ")
+			}
 			if err != nil {
 				ClientErrorMsg(err)
 			}
+
+			if str == "" && note.Kind == NoteSecret {
+				if str, err = PromptGenerate(); err != nil {
+					fmt.Println(err)
+					continue
+				}
+			}
 			note.Data = str
 
+			note.Language = ""
+			note.Items = nil
+			if note.Kind == NoteChecklist {
+				for _, text := range ScanList("enter items (comma separated): ") {
+					if text = strings.TrimSpace(text); text != "" {
+						note.Items = append(note.Items, ChecklistItem{Text: text})
+					}
+				}
+			} else if note.Kind != NoteSecret {
+				if note.Language, err = ScanString("enter language (sql/shell/go/json/yaml/..., empty for none): "); err != nil {
+					ClientErrorMsg(err)
+				}
+			}
+			note.Tags = ScanList("enter tags (comma separated): ")
+
+			if note.Notebook, err = ScanString("enter notebook (empty for root): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if err = CreateNote(conn, note); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("note has been added")
+		case "add from template":
+			if note.Id, err = ScanInt("enter template id: "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			template, err := GetNote(conn, note)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if template.Kind != NoteTemplate {
+				fmt.Printf("note %d is not a template\n", template.Id)
+				continue
+			}
+
+			values := TemplateBuiltins(user_name, time.Now())
+			for _, name := range TemplatePlaceholders(values, template.Title, template.Data) {
+				if values[strings.ToLower(name)], err = ScanString("enter " + name + ": "); err != nil {
+					ClientErrorMsg(err)
+				}
+			}
+
+			note = Note{Kind: NotePlain, Language: template.Language, Tags: template.Tags}
+			note.Title = FillTemplate(template.Title, values)
+			note.Data = FillTemplate(template.Data, values)
+
+			if str, err = ScanString("enter title (empty for \"" + note.Title + "\"): "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if str != "" {
+				note.Title = str
+			}
+
+			if note.Notebook, err = ScanString("enter notebook (empty for root): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
 			if err = CreateNote(conn, note); err != nil {
 				fmt.Println(err)
 				continue
 			}
 
 			fmt.Println("note has been added")
+		case "templates":
+			notes, err := FindNotes(conn, "kind:"+NoteTemplate)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			shared, err := GetSharedWithMe(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				fmt.Printf("%d\t%s\n", note.Id, note.Title)
+			}
+
+			for _, note := range shared {
+				if note.Kind == NoteTemplate {
+					fmt.Printf("%d\t%s\t(owner: %s)\n", note.Id, note.Title, note.Owner)
+				}
+			}
 		case "get":
 			str, err = ScanString("enter note id: ")
 			if err != nil {
@@ -158,7 +423,7 @@ func MsgManager(conn net.Conn) {
 				ClientErrorMsg(err)
 			}
 
-			notes, err := GetAllNotesByTitle(conn, note)
+			notes, err := GetAllNotesByTitle(conn, TitleFilterData{Title: note.Title})
 			if err != nil {
 				fmt.Println(err)
 				continue
@@ -178,12 +443,81 @@ func MsgManager(conn net.Conn) {
 				ClientErrorMsg(err)
 			}
 
-			if err = DeleteNote(conn, note); err != nil {
+			current, err := GetNote(conn, note)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			note.Version = current.Version
+
+			if !Confirm(fmt.Sprintf("move note %d \"%s\" to the trash?", note.Id, current.Title)) {
+				continue
+			}
+
+			for {
+				err = DeleteNote(conn, note)
+
+				var conflict *ConflictError
+				if !errors.As(err, &conflict) {
+					break
+				}
+
+				fmt.Println(err)
+				conflict.Current.ViewNote()
+				if !Confirm("move it to the trash anyway?") {
+					break
+				}
+				note.Version = conflict.Current.Version
+			}
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("note was moved to the trash")
+		case "trash":
+			notes, err := GetTrashNotes(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				note.ViewNote()
+				fmt.Println()
+			}
+		case "restore":
+			if str, err = ScanString("enter note id: "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if note.Id, err = strconv.Atoi(str); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if err = RestoreNote(conn, note); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("note was restored")
+		case "purge":
+			if str, err = ScanString("enter note id: "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if note.Id, err = strconv.Atoi(str); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if !Confirm(fmt.Sprintf("permanently delete note %d?", note.Id)) {
+				continue
+			}
+
+			if err = PurgeNote(conn, note); err != nil {
 				fmt.Println(err)
 				continue
 			}
 
-			fmt.Println("note was deleted")
+			fmt.Println("note was permanently deleted")
 		case "update":
 			if str, err = ScanString("enter note id: "); err != nil {
 				ClientErrorMsg(err)
@@ -209,31 +543,1278 @@ func MsgManager(conn net.Conn) {
 
 			// }
 
-			if note.Title, err = ScanString("enter new title: "); err != nil {
+			current, err := GetNote(conn, note)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			note.Version = current.Version
+
+			if note.Title, err = ScanString("enter new title (empty to keep): "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if note.Title == "" {
+				note.Title = current.Title
+			}
+			note.RewriteLinks = note.Title != current.Title && Confirm("rewrite links to the old title in other notes?")
+
+			if note.Data, err = ScanString("enter new query (empty to keep): "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if note.Data == "" {
+				note.Data = current.Data
+			}
+			note.Tags = ScanList("enter new tags (empty to keep): ")
+
+			if note.Kind, err = ScanString("enter new kind (empty to keep): "); err != nil {
 				ClientErrorMsg(err)
 			}
 
-			if note.Data, err = ScanString("enter new query: "); err != nil {
+			if note.Language, err = ScanString("enter new language (empty to keep, none to remove): "); err != nil {
 				ClientErrorMsg(err)
 			}
 
-			if err = UpdateNote(conn, note); err != nil {
+			for {
+				err = UpdateNote(conn, note)
+
+				var conflict *ConflictError
+				if !errors.As(err, &conflict) || !ResolveConflict(conflict, note) {
+					break
+				}
+				note.Version = conflict.Current.Version
+			}
+			if err != nil {
 				fmt.Println(err)
 				continue
 			}
 
 			fmt.Println("note was updated")
-		case "help":
-			fmt.Println("add(create new note)")
-			fmt.Println("update(update note)")
-			fmt.Println("delete(delete note)")
-			fmt.Println("get(get note by id)")
-			fmt.Println("get all(get all notes)")
-			fmt.Println("get by title(get all notes by title)")
-			fmt.Println("quit(quit from application)")
-		case "quit":
-			conn.Close()
-			os.Exit(0)
-		}
-	}
+		case "tag", "untag":
+			if note.Id, err = ScanInt("enter note id: "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			tags := ScanList("enter tags (comma separated): ")
+			if str == "tag" {
+				err = TagNote(conn, note.Id, tags)
+			} else {
+				err = UntagNote(conn, note.Id, tags)
+			}
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("note tags were changed")
+		case "tags":
+			tags, err := GetTags(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, tag := range tags {
+				fmt.Printf("%s (%d)\n", tag.Name, tag.Count)
+			}
+		case "get by tag":
+			filter := TagFilterData{Tags: ScanList("enter tags (comma separated): ")}
+			if len(filter.Tags) > 1 {
+				filter.MatchAll = Confirm("notes must have all of the tags?")
+			}
+			if filter.Title, err = ScanString("enter title (empty for any): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			notes, err := GetNotesByTags(conn, filter)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				note.ViewNote()
+				fmt.Println()
+			}
+		case "search":
+			if str, err = ScanString("enter search query: "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			results, err := SearchNotes(conn, str)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, result := range results {
+				fmt.Printf("%d\t%s\n", result.Id, result.Title)
+				if result.Kind == NoteSecret {
+					fmt.Println("\t********")
+					continue
+				}
+				fmt.Printf("\t%s\n", Highlight(strings.ReplaceAll(result.Snippet, "\n", " ")))
+			}
+		case "find":
+			if str, err = ScanString("enter filter (e.g. lang:sql updated:>2026-01-01 -tag:archived): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			notes, err := FindNotes(conn, str)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				note.ViewNote()
+				fmt.Println()
+			}
+		case "bulk delete", "bulk tag", "bulk untag":
+			if err = BulkCommand(conn, strings.TrimPrefix(str, "bulk ")); err != nil {
+				fmt.Println(err)
+			}
+		case "share":
+			share := ShareData{}
+			if str, err = ScanString("enter note id or notebook path: "); err != nil {
+				ClientErrorMsg(err)
+			}
+			if share.NoteId, err = strconv.Atoi(str); err != nil {
+				share.Notebook = str
+			}
+
+			if share.UserName, err = ScanString("enter user name: "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if share.Permission, err = ScanString("enter permission (read/write): "); err != nil {
+				ClientErrorMsg(err)
+			}
+
+			if err = CreateShare(conn, share); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("shared")
+		case "shares":
+			shares, err := GetShares(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, share := range shares {
+				if share.NoteId != nil {
+					fmt.Printf("%d\tnote %d \"%s\" -> %s (%s)\n", share.Id, *share.NoteId, share.NoteTitle, share.UserName, share.Permission)
+				} else {
+					fmt.Printf("%d\tnotebook %s/ -> %s (%s)\n", share.Id, share.Notebook, share.UserName, share.Permission)
+				}
+			}
+		case "unshare":
+			share := ShareData{}
+			if share.Id, err = ScanInt("enter share id (see shares): "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			if err = RevokeShare(conn, share); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println("share was revoked")
+		case "shared":
+			notes, err := GetSharedWithMe(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				note.ViewNote()
+				fmt.Printf("owner: %s (%s)\n\n", note.Owner, note.Permission)
+			}
+		case "reveal":
+			if note.Id, err = ScanInt("enter note id: "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			note_ptr, err := GetNote(conn, note)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println(note_ptr.Data)
+			ClearLater(time.Duration(config.RevealClearSeconds) * time.Second)
+		case "genpass":
+			password, err := PromptGenerate()
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Println(password)
+			ClearLater(time.Duration(config.RevealClearSeconds) * time.Second)
+		case "totp":
+			if note.Id, err = ScanInt("enter note id: "); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			note_ptr, err := GetNote(conn, note)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			totp, err := FindOTPAuth(note_ptr.Data)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			code, left := totp.Code(time.Now())
+			fmt.Printf("%s (valid for %d s)\n", code, int(left.Seconds()))
+		case "favorites":
+			notes, err := FindNotes(conn, "is:favorite")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, note := range notes {
+				note.ViewNote()
+				fmt.Println()
+			}
+		case "upcoming":
+			reminders, err := GetReminders(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			for _, reminder := range reminders {
+				fmt.Printf("%s\t%d\t%s", reminder.DueAt.Local().Format("2006-01-02 15:04"), reminder.NoteId, reminder.Title)
+				if reminder.Repeat != "" {
+					fmt.Printf("\t(every %s)", reminder.Repeat)
+				}
+				fmt.Println()
+			}
+		case "usage":
+			usage, err := GetUsage(conn)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			limit := func(max int64, format func(int64) string) string {
+				if max == 0 {
+					return "unlimited"
+				}
+				return format(max)
+			}
+			count := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+			fmt.Printf("notes: %d of %s\n", usage.Notes, limit(int64(usage.MaxNotes), count))
+			fmt.Printf("storage: %s of %s (%d attachments)\n", FormatBytes(usage.Bytes),
+				limit(usage.MaxBytes, FormatBytes), usage.Attachments)
+			fmt.Printf("max note size: %s\n", limit(int64(usage.MaxNoteSize), FormatBytes))
+		case "encrypt":
+			if workspace != "" {
+				fmt.Println("switch to your personal notes first (ws use)")
+				continue
+			}
+
+			if err = TurnOnEncryption(conn); err != nil {
+				fmt.Println(err)
+			}
+		case "help":
+			fmt.Println("add(create new note)")
+			fmt.Println("add from template(create new note from template)")
+			fmt.Println("templates(list your templates and templates shared with you)")
+			fmt.Println("update(update note)")
+			fmt.Println("delete(move note to the trash)")
+			fmt.Println("trash(list notes in the trash)")
+			fmt.Println("restore(restore note from the trash)")
+			fmt.Println("purge(permanently delete note from the trash)")
+			fmt.Println("get(get note by id)")
+			fmt.Println("reveal(show query of secret note)")
+			fmt.Println("genpass(generate password or passphrase)")
+			fmt.Println("totp(show current code of note with otpauth:// URI)")
+			fmt.Println("run <note id> [data source] [--csv|--json] [--write](run SQL snippet, writes need --write)")
+			fmt.Println("links <note id>(list links of note to other notes)")
+			fmt.Println("backlinks <note id>(list notes linking to note)")
+			fmt.Println("follow <note id> <n>(show note the n-th link of note points to)")
+			fmt.Println("attach <note id> <path>(attach file to note)")
+			fmt.Println("attachments <note id>(list attachments of note)")
+			fmt.Println("detach <attachment id>(delete attachment)")
+			fmt.Println("download <attachment id> [path](save attachment to file)")
+			fmt.Println("usage(show how much you store and your quotas)")
+			fmt.Println("pin <note id>(show note first in lists)")
+			fmt.Println("unpin <note id>(stop showing note first)")
+			fmt.Println("favorite <note id>(add note to favorites)")
+			fmt.Println("unfavorite <note id>(remove note from favorites)")
+			fmt.Println("favorites(list favorite notes)")
+			fmt.Println("check <note id> <n>(check n-th item of checklist)")
+			fmt.Println("uncheck <note id> <n>(uncheck n-th item of checklist)")
+			fmt.Println("item add <note id> <text>(add item to the end of checklist)")
+			fmt.Println("item mv <note id> <n> <position>(move n-th item of checklist)")
+			fmt.Println("item rm <note id> <n>(remove n-th item of checklist)")
+			fmt.Println("remind <note id> <when> [every <repeat>](remind you of note, when is YYYY-MM-DD [HH:MM], HH:MM or +2h,")
+			fmt.Println("    repeat is daily, weekly, monthly, yearly or a cron expression like 0 9 * * 1-5)")
+			fmt.Println("unremind <note id>(delete reminder of note)")
+			fmt.Println("upcoming(list your reminders)")
+			fmt.Println("get all(get all notes)")
+			fmt.Println("get by title(get all notes by title)")
+			fmt.Println("tag(add tags to note)")
+			fmt.Println("untag(remove tags from note)")
+			fmt.Println("tags(list all tags)")
+			fmt.Println("get by tag(get all notes having any or all of tags)")
+			fmt.Println("search(full text search in titles and queries)")
+			fmt.Println("find(filter notes by fields: tag:, lang:, kind:, is:, title:, body:, created:, updated:)")
+			fmt.Println("bulk delete(move all notes matching a filter to the trash at once)")
+			fmt.Println("bulk tag(add tags to all notes matching a filter at once)")
+			fmt.Println("bulk untag(remove tags from all notes matching a filter at once)")
+			fmt.Println("export <json|md|csv> <path>(export all notes to a JSON file, a directory of Markdown files or a CSV file)")
+			fmt.Println("encrypt(turn on end-to-end encryption of your notes)")
+			fmt.Println("share(share note or notebook with another user)")
+			fmt.Println("shares(list what you shared)")
+			fmt.Println("unshare(revoke share)")
+			fmt.Println("shared(list notes shared with you)")
+			fmt.Println("ls [path] [-s id|title|created|updated] [-r](list notebook, -s sorts and -r reverses)")
+			fmt.Println("ls -a [-s id|title|created|updated] [-r](list ids, titles and update times of all notes)")
+			fmt.Println("mkdir <path>(create notebook)")
+			fmt.Println("rmdir <path>(delete empty notebook)")
+			fmt.Println("rename <path> <name>(rename notebook)")
+			fmt.Println("mvdir <path> <parent path>(move notebook)")
+			fmt.Println("mv <note id> <path>(move note to notebook)")
+			fmt.Println("ws(list your workspaces)")
+			fmt.Println("ws create <name>(create workspace)")
+			fmt.Println("ws use [name](work in workspace, without name in your personal notes)")
+			fmt.Println("ws members <name>(list members of workspace)")
+			fmt.Println("ws invite <name> <user> <owner|editor|viewer>(add member or change role)")
+			fmt.Println("ws remove <name> <user>(remove member)")
+			fmt.Println("quit(quit from application)")
+		case "quit":
+			conn.Close()
+			os.Exit(0)
+		default:
+			if len(args) == 0 {
+				continue
+			}
+
+			if args[0] == "ws" {
+				err = WorkspaceCommand(conn, args, &workspace)
+			} else if args[0] == "run" {
+				err = RunCommand(conn, args, config)
+			} else if args[0] == "pin" || args[0] == "unpin" || args[0] == "favorite" || args[0] == "unfavorite" {
+				err = FlagCommand(conn, args)
+			} else if args[0] == "item" || args[0] == "check" || args[0] == "uncheck" {
+				err = ChecklistCommand(conn, args)
+			} else if args[0] == "export" {
+				err = ExportCommand(conn, args)
+			} else if args[0] == "remind" || args[0] == "unremind" {
+				err = ReminderCommand(conn, args)
+			} else if args[0] == "links" || args[0] == "backlinks" || args[0] == "follow" {
+				err = LinkCommand(conn, args)
+			} else if args[0] == "attach" || args[0] == "attachments" || args[0] == "detach" || args[0] == "download" {
+				err = AttachmentCommand(conn, args)
+			} else {
+				err = NotebookCommand(conn, args)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+	}
+}
+
+// ResolveConflict shows how the note on the server differs from the edited
+// one and asks whether the edit should overwrite it.
+func ResolveConflict(conflict *ConflictError, edited Note) bool {
+	fmt.Println(conflict)
+
+	if Confirm("show the difference between the server version and yours?") {
+		current := conflict.Current
+		for _, line := range LineDiff("title: "+current.Title+"\n"+current.Data, "title: "+edited.Title+"\n"+edited.Data) {
+			fmt.Println(line)
+		}
+	}
+
+	return Confirm("save your version over it?")
+}
+
+// ScanIntDefault reads a number, an empty answer gives def.
+func ScanIntDefault(text string, def int) (int, error) {
+	str, err := ScanString(fmt.Sprintf("%s[%d]: ", text, def))
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if strings.TrimSpace(str) == "" {
+		return def, nil
+	}
+
+	return strconv.Atoi(strings.TrimSpace(str))
+}
+
+// PromptGenerate asks how to generate a password and generates it, nothing
+// of it is sent to the server until it is saved in a note.
+func PromptGenerate() (string, error) {
+	mode, err := ScanString("generate password (p) or passphrase (w)? [p]: ")
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if strings.TrimSpace(mode) == "w" {
+		words, err := ScanIntDefault("number of words ", 6)
+		if err != nil {
+			return "", err
+		}
+
+		return GeneratePassphrase(words, "-")
+	}
+
+	length, err := ScanIntDefault("length ", 20)
+	if err != nil {
+		return "", err
+	}
+
+	charsets := ScanList("charsets (lower,upper,digits,symbols, empty for all): ")
+	return GeneratePassword(length, charsets)
+}
+
+// ClearLater clears the terminal after d so that a revealed secret doesn't
+// stay on the screen, it does nothing when d is 0 or stdout isn't a terminal.
+func ClearLater(d time.Duration) {
+	if d <= 0 || !IsTerminal() {
+		return
+	}
+
+	time.AfterFunc(d, func() {
+		// clear the screen together with the scrollback
+		fmt.Print("\033[H\033[2J\033[3J")
+		fmt.Print("revealed note was cleared, press enter\n")
+	})
+}
+
+// IsTerminal reports whether stdout is a terminal rather than a file or pipe.
+func IsTerminal() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Highlight shows the parts of a search snippet marked by the server in bold
+// on a terminal and between asterisks otherwise.
+func Highlight(snippet string) string {
+	if IsTerminal() {
+		return strings.NewReplacer(HighlightStart, "\033[1m", HighlightEnd, "\033[0m").Replace(snippet)
+	}
+
+	return strings.NewReplacer(HighlightStart, "*", HighlightEnd, "*").Replace(snippet)
+}
+
+// NotebookCommand runs the notebook commands which take their arguments on
+// the command line, like "ls work/sql".
+func NotebookCommand(conn net.Conn, args []string) error {
+	usage := map[string]int{"ls": 1, "mkdir": 2, "rmdir": 2, "rename": 3, "mvdir": 3, "mv": 3}
+
+	n, ok := usage[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command, enter help")
+	}
+
+	if len(args) < n {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	switch args[0] {
+	case "ls":
+		return ListCommand(conn, args)
+	case "mkdir":
+		if err := CreateNotebook(conn, args[1]); err != nil {
+			return err
+		}
+		fmt.Println("notebook was created")
+	case "rmdir":
+		if err := DeleteNotebook(conn, args[1]); err != nil {
+			return err
+		}
+		fmt.Println("notebook was deleted")
+	case "rename":
+		if err := RenameNotebook(conn, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("notebook was renamed")
+	case "mvdir":
+		if err := MoveNotebook(conn, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("notebook was moved")
+	case "mv":
+		note_id, err := strconv.Atoi(args[1])
+		if err != nil {
+			return err
+		}
+
+		if err = MoveNote(conn, note_id, args[2]); err != nil {
+			return err
+		}
+		fmt.Println("note was moved")
+	}
+
+	return nil
+}
+
+// FlagCommand pins and unpins notes and adds them to or removes them from
+// favorites.
+func FlagCommand(conn net.Conn, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	note_id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+
+	flag, value := "pinned", true
+	switch args[0] {
+	case "unpin":
+		value = false
+	case "favorite":
+		flag = "favorite"
+	case "unfavorite":
+		flag, value = "favorite", false
+	}
+
+	if err = SetNoteFlag(conn, note_id, flag, value); err != nil {
+		return err
+	}
+
+	fmt.Println("note was updated")
+	return nil
+}
+
+// BulkCommand deletes, tags or untags all notes matching a filter in one
+// request after asking for confirmation, either all of them are changed
+// or none.
+func BulkCommand(conn net.Conn, op string) error {
+	filter, err := ScanString("enter filter (e.g. tag:old -is:pinned): ")
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if strings.TrimSpace(filter) == "" {
+		return fmt.Errorf("filter is empty, bulk commands don't run on all notes")
+	}
+
+	notes, err := FindNotes(conn, filter)
+	if err != nil {
+		return err
+	}
+
+	if len(notes) == 0 {
+		return fmt.Errorf("no notes match the filter")
+	}
+
+	var tags []string
+	if op != "delete" {
+		if tags = ScanList("enter tags (comma separated): "); len(tags) == 0 {
+			return fmt.Errorf("no tags were entered")
+		}
+	}
+
+	for _, note := range notes {
+		title := note.Title
+		if IsEncrypted(title) {
+			title = "(encrypted)"
+		}
+		fmt.Printf("%d\t%s\n", note.Id, title)
+	}
+
+	question := map[string]string{
+		"delete": "move these %d notes to the trash?",
+		"tag":    "add the tags to these %d notes?",
+		"untag":  "remove the tags from these %d notes?",
+	}
+	if !Confirm(fmt.Sprintf(question[op], len(notes))) {
+		fmt.Println("nothing was changed")
+		return nil
+	}
+
+	ops := make([]BulkOp, len(notes))
+	for i, note := range notes {
+		ops[i] = BulkOp{Op: op, Note: Note{Id: note.Id, Version: note.Version}, Tags: tags}
+	}
+
+	result, err := Bulk(conn, ops)
+	if err != nil {
+		return err
+	}
+
+	if !result.Committed {
+		for i, res := range result.Results {
+			if res.Error != "" {
+				fmt.Printf("note %d: %s\n", notes[i].Id, res.Error)
+			}
+		}
+		return fmt.Errorf("nothing was changed")
+	}
+
+	done := map[string]string{
+		"delete": "%d notes were moved to the trash\n",
+		"tag":    "%d notes were tagged\n",
+		"untag":  "%d notes were untagged\n",
+	}
+	fmt.Printf(done[op], len(notes))
+	return nil
+}
+
+// ListCommand lists a notebook or, with -a, notes of all notebooks as a
+// compact index without their queries. -s sorts by id, title, created or
+// updated and -r reverses the order.
+func ListCommand(conn net.Conn, args []string) error {
+	opts := ListOptions{}
+	all, path := false, ""
+
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "-a":
+			all = true
+		case "-r":
+			opts.Desc = true
+		case "-s":
+			if i+1 == len(args) {
+				return fmt.Errorf("-s needs a field: id, title, created or updated")
+			}
+			i++
+			opts.Sort = args[i]
+		default:
+			if path != "" || strings.HasPrefix(args[i], "-") {
+				return fmt.Errorf("wrong arguments for ls, enter help")
+			}
+			path = args[i]
+		}
+	}
+
+	if opts.Desc && opts.Sort == "" {
+		opts.Sort = "id"
+	}
+
+	if err := opts.Check(); err != nil {
+		return err
+	}
+
+	progress := func(note Note) string {
+		if note.Kind != NoteChecklist {
+			return ""
+		}
+
+		done, total := ChecklistProgress(note.Items)
+		return fmt.Sprintf("[%d/%d]", done, total)
+	}
+
+	if !all {
+		list, err := ListNotebook(conn, path)
+		if err != nil {
+			return err
+		}
+		SortNotes(list.Notes, opts)
+
+		for _, name := range list.Notebooks {
+			fmt.Printf("%s/\n", name)
+		}
+		for _, note := range list.Notes {
+			fmt.Println(strings.TrimSpace(fmt.Sprintf("%d\t%s\t%s", note.Id, note.Title, progress(note))))
+		}
+		return nil
+	}
+
+	if path != "" {
+		return fmt.Errorf("ls -a lists notes of all notebooks, leave out the path")
+	}
+
+	opts.Fields = []string{"title", "kind", "items", "updated"}
+	notes, err := ListNotes(conn, opts)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, note := range notes {
+		title := note.Title
+		if IsEncrypted(title) {
+			title = "(encrypted)"
+		}
+		if note.Pinned {
+			title = "* " + title
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", note.Id, title, note.UpdatedAt.Local().Format("2006-01-02 15:04"), progress(note))
+	}
+
+	return w.Flush()
+}
+
+// PrintChecklist prints items as a numbered list of [x] and [ ] boxes.
+func PrintChecklist(items []ChecklistItem) {
+	for i, item := range items {
+		box, text := "[ ]", item.Text
+		if item.Checked {
+			box = "[x]"
+		}
+		if IsEncrypted(text) {
+			text = "(encrypted)"
+		}
+		fmt.Printf("  %d. %s %s\n", i+1, box, text)
+	}
+}
+
+// ChecklistCommand adds, checks, unchecks, moves and removes items of
+// checklists, items are given by their number in the checklist.
+func ChecklistCommand(conn net.Conn, args []string) error {
+	if args[0] == "item" {
+		usage := map[string]int{"add": 4, "mv": 5, "rm": 4}
+		if len(args) < 2 || usage[args[1]] == 0 {
+			return fmt.Errorf("use item add, item mv or item rm, enter help")
+		}
+		if len(args) < usage[args[1]] || (args[1] != "add" && len(args) != usage[args[1]]) {
+			return fmt.Errorf("wrong number of arguments for item %s, enter help", args[1])
+		}
+		args = args[1:]
+	} else if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	note_id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+
+	item := ChecklistItem{NoteId: note_id, Text: strings.Join(args[2:], " ")}
+	if args[0] != "add" {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+
+		note, err := GetNote(conn, Note{Id: note_id})
+		if err != nil {
+			return err
+		}
+
+		if note.Kind != NoteChecklist {
+			return fmt.Errorf("note %d is not a checklist", note_id)
+		}
+
+		if n < 1 || n > len(note.Items) {
+			return fmt.Errorf("checklist %d has %d items", note_id, len(note.Items))
+		}
+		item = note.Items[n-1]
+	}
+
+	Type := ItemAddT
+	switch args[0] {
+	case "check", "uncheck":
+		Type, item.Checked = ItemCheckT, args[0] == "check"
+	case "mv":
+		Type = ItemMoveT
+		if item.Position, err = strconv.Atoi(args[3]); err != nil {
+			return err
+		}
+	case "rm":
+		Type = ItemRemoveT
+	}
+
+	items, err := ChecklistItemRequest(conn, Type, item)
+	if err != nil {
+		return err
+	}
+
+	done, total := ChecklistProgress(items)
+	fmt.Printf("progress: %d/%d\n", done, total)
+	PrintChecklist(items)
+	return nil
+}
+
+// ReminderCommand sets and deletes reminders, "remind <id> every <repeat>"
+// is first due when repeat is.
+func ReminderCommand(conn net.Conn, args []string) error {
+	if len(args) < 2 || (args[0] == "remind" && len(args) < 3) || (args[0] == "unremind" && len(args) != 2) {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	note_id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "unremind" {
+		if err = DeleteReminder(conn, note_id); err != nil {
+			return err
+		}
+
+		fmt.Println("reminder was deleted")
+		return nil
+	}
+
+	reminder := Reminder{NoteId: note_id}
+	when := args[2:]
+	for i, arg := range when {
+		if arg == "every" {
+			reminder.Repeat = strings.Join(when[i+1:], " ")
+			when = when[:i]
+			break
+		}
+	}
+
+	if len(when) > 0 {
+		if reminder.DueAt, err = ParseDueTime(strings.Join(when, " "), time.Now()); err != nil {
+			return err
+		}
+	}
+
+	set, err := SetReminder(conn, reminder)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("you will be reminded on %s\n", set.DueAt.Local().Format("2006-01-02 15:04"))
+	return nil
+}
+
+// ShowNotifications prints reminders pushed by the server as they come.
+func ShowNotifications(notifications <-chan MessageData) {
+	for msg := range notifications {
+		reminder := Reminder{}
+		if err := json.Unmarshal(msg.Data, &reminder); err != nil {
+			continue
+		}
+
+		reminders := []Reminder{reminder}
+		decryptReminderTitles(reminders)
+		fmt.Printf("\n*** reminder: note %d \"%s\" is due (%s)\n", reminder.NoteId, reminders[0].Title,
+			reminder.DueAt.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+// LinkCommand runs commands for [[Title]] and [[#id]] links between notes.
+func LinkCommand(conn net.Conn, args []string) error {
+	if len(args) != 2 && !(args[0] == "follow" && len(args) == 3) {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	note_id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "links":
+		links, err := GetNoteLinks(conn, note_id)
+		if err != nil {
+			return err
+		}
+
+		for i, link := range links {
+			if link.TargetId == nil {
+				fmt.Printf("%d\t[[%s]]\t(no such note)\n", i+1, link.Target)
+				continue
+			}
+			fmt.Printf("%d\t[[%s]]\t%d\t%s\n", i+1, link.Target, *link.TargetId, link.Title)
+		}
+	case "backlinks":
+		notes, err := GetBacklinks(conn, note_id)
+		if err != nil {
+			return err
+		}
+
+		for _, note := range notes {
+			fmt.Printf("%d\t%s\n", note.Id, note.Title)
+		}
+	case "follow":
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return err
+		}
+
+		links, err := GetNoteLinks(conn, note_id)
+		if err != nil {
+			return err
+		}
+
+		if n < 1 || n > len(links) {
+			return fmt.Errorf("note %d has %d links", note_id, len(links))
+		}
+
+		link := links[n-1]
+		if link.TargetId == nil {
+			return fmt.Errorf("link [[%s]] doesn't point to any note", link.Target)
+		}
+
+		note, err := GetNote(conn, Note{Id: *link.TargetId})
+		if err != nil {
+			return err
+		}
+
+		note.ViewNote()
+	}
+
+	return nil
+}
+
+// ExportCommand exports all notes to a file or directory.
+func ExportCommand(conn net.Conn, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("wrong number of arguments for export, enter help")
+	}
+
+	count, err := ExportNotes(conn, args[1], args[2])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d notes were exported to %s\n", count, args[2])
+	return nil
+}
+
+// AttachmentCommand runs commands for files attached to notes.
+func AttachmentCommand(conn net.Conn, args []string) error {
+	usage := map[string][2]int{"attach": {3, 3}, "attachments": {2, 2}, "detach": {2, 2}, "download": {2, 3}}
+
+	n := usage[args[0]]
+	if len(args) < n[0] || len(args) > n[1] {
+		return fmt.Errorf("wrong number of arguments for %s, enter help", args[0])
+	}
+
+	id, err := strconv.Atoi(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "attach":
+		attachment, err := UploadAttachment(conn, id, args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("attachment %d was added\n", attachment.Id)
+	case "attachments":
+		attachments, err := GetAttachments(conn, id)
+		if err != nil {
+			return err
+		}
+
+		for _, attachment := range attachments {
+			fmt.Printf("%d\t%s\t%d bytes\t%s\n", attachment.Id, attachment.Name, attachment.Size,
+				attachment.CreatedAt.Local().Format("2006-01-02 15:04"))
+		}
+	case "detach":
+		if !Confirm("delete attachment?") {
+			return nil
+		}
+
+		if err = DeleteAttachment(conn, id); err != nil {
+			return err
+		}
+		fmt.Println("attachment was deleted")
+	case "download":
+		path := ""
+		if len(args) > 2 {
+			path = args[2]
+		}
+
+		if path, err = DownloadAttachment(conn, id, path); err != nil {
+			return err
+		}
+		fmt.Printf("attachment was saved to %s\n", path)
+	}
+
+	return nil
+}
+
+// WorkspaceCommand runs "ws" commands, the name of the active workspace is
+// kept in workspace for the prompt.
+func WorkspaceCommand(conn net.Conn, args []string, workspace *string) error {
+	if len(args) == 1 {
+		workspaces, err := GetWorkspaces(conn)
+		if err != nil {
+			return err
+		}
+
+		for _, w := range workspaces {
+			fmt.Printf("%s (%s)\n", w.Name, w.Role)
+		}
+		return nil
+	}
+
+	usage := map[string]int{"create": 3, "use": 2, "members": 3, "invite": 5, "remove": 4}
+	if n, ok := usage[args[1]]; !ok || len(args) < n {
+		return fmt.Errorf("wrong ws command, enter help")
+	}
+
+	switch args[1] {
+	case "create":
+		if err := CreateWorkspace(conn, args[2]); err != nil {
+			return err
+		}
+		fmt.Println("workspace was created")
+	case "use":
+		name := ""
+		if len(args) > 2 {
+			name = args[2]
+		}
+
+		if err := SwitchWorkspace(conn, name); err != nil {
+			return err
+		}
+		*workspace = name
+
+		// members of the workspace can't decrypt notes
+		if noteCipher != nil {
+			noteCipher.Suspended = name != ""
+		}
+	case "members":
+		members, err := GetWorkspaceMembers(conn, args[2])
+		if err != nil {
+			return err
+		}
+
+		for _, member := range members {
+			fmt.Printf("%s (%s)\n", member.UserName, member.Role)
+		}
+	case "invite":
+		if err := SetWorkspaceMember(conn, args[2], args[3], args[4]); err != nil {
+			return err
+		}
+		fmt.Println("member was saved")
+	case "remove":
+		if err := RemoveWorkspaceMember(conn, args[2], args[3]); err != nil {
+			return err
+		}
+		fmt.Println("member was removed")
+	}
+
+	return nil
+}
+
+// UnlockNotes asks for the passphrase when the user has turned on
+// end-to-end encryption.
+func UnlockNotes(conn net.Conn) error {
+	key, err := GetKeyCheck(conn)
+	if err != nil {
+		return err
+	}
+
+	if key.Salt == "" {
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		passphrase, err := ScanString("enter passphrase: ")
+		if err != nil {
+			return err
+		}
+
+		if noteCipher, err = OpenNoteCipher(passphrase, *key); err == nil {
+			return nil
+		}
+		fmt.Println(err)
+	}
+
+	return fmt.Errorf("notes can't be decrypted without the passphrase")
+}
+
+// TurnOnEncryption sets up a passphrase and encrypts the existing notes.
+// The passphrase can't be recovered, notes are lost without it.
+func TurnOnEncryption(conn net.Conn) error {
+	if noteCipher != nil {
+		return fmt.Errorf("encryption is already turned on")
+	}
+
+	passphrase, err := ScanString("enter new passphrase: ")
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if len(passphrase) < 8 {
+		return fmt.Errorf("passphrase must be at least 8 characters long")
+	}
+
+	repeated, err := ScanString("repeat passphrase: ")
+	if err != nil {
+		ClientErrorMsg(err)
+	}
+
+	if repeated != passphrase {
+		return fmt.Errorf("passphrases don't match")
+	}
+
+	titles := Confirm("encrypt titles too? (search by title will run on this computer)")
+
+	c, key, err := NewNoteCipher(passphrase, titles)
+	if err != nil {
+		return err
+	}
+
+	if err = SetKeyCheck(conn, *key); err != nil {
+		return err
+	}
+	noteCipher = c
+
+	notes, err := GetAllNotes(conn)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for _, note := range notes {
+		if IsEncrypted(note.Data) {
+			continue
+		}
+
+		// tags are kept as they are
+		note.Tags = nil
+		if err = UpdateNote(conn, note); err != nil {
+			fmt.Printf("note %d: %s\n", note.Id, err)
+			continue
+		}
+		count++
+	}
+
+	fmt.Printf("encryption is turned on, %d notes were encrypted\n", count)
+	fmt.Println("notes in the trash stay unencrypted until they are restored and updated")
+	return nil
+}
+
+// SetupAtRest turns on encryption of notes in the database when a master
+// key is configured.
+func SetupAtRest(master_key_file string) error {
+	key, err := ReadMasterKey(master_key_file)
+	if err != nil || key == nil {
+		return err
+	}
+
+	atRest, err = NewAtRest(key)
+	return err
+}
+
+// RotateKeyCommand re-encrypts the database with the master key in file,
+// the current key is the configured one.
+func RotateKeyCommand(file string) error {
+	f, err := GetConfigFileData("config.json")
+	if err != nil {
+		return err
+	}
+
+	if err = SetupAtRest(f.MasterKeyFile); err != nil {
+		return err
+	}
+	old := atRest
+
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	new_key, err := ParseMasterKey(string(b))
+	if err != nil {
+		return err
+	}
+
+	if atRest, err = NewAtRest(new_key); err != nil {
+		return err
+	}
+
+	db, err := CreateConn("sqlite3", "notes.db")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return RotateMasterKey(db, old, atRest, 100)
+}
+
+// RunCommand runs the SQL note given in args against a data source of the
+// config, like "run 12 reports --csv".
+func RunCommand(conn net.Conn, args []string, config *ConfigFile) error {
+	format, write := "table", false
+	positional := make([]string, 0, 2)
+
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--csv":
+			format = "csv"
+		case "--json":
+			format = "json"
+		case "--write":
+			write = true
+		default:
+			if strings.HasPrefix(arg, "--") {
+				return fmt.Errorf("unknown flag %s, enter help", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+
+	if len(positional) < 1 || len(positional) > 2 {
+		return fmt.Errorf("wrong number of arguments for run, enter help")
+	}
+
+	note_id, err := strconv.Atoi(positional[0])
+	if err != nil {
+		return err
+	}
+
+	if len(config.DataSources) == 0 {
+		return fmt.Errorf("no data sources in config.json, add them to data_sources")
+	}
+
+	name := ""
+	if len(positional) == 2 {
+		name = positional[1]
+	} else if len(config.DataSources) == 1 {
+		for name = range config.DataSources {
+		}
+	} else {
+		return fmt.Errorf("enter the data source to run the note against")
+	}
+
+	source, ok := config.DataSources[name]
+	if !ok {
+		return fmt.Errorf("unknown data source \"%s\"", name)
+	}
+
+	note, err := GetNote(conn, Note{Id: note_id})
+	if err != nil {
+		return err
+	}
+
+	if note.Kind != NoteSnippet || note.Language != "sql" {
+		return fmt.Errorf("note %d is not an SQL snippet, set its kind to snippet and its language to sql", note_id)
+	}
+
+	db, err := OpenDataSource(source, write)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	values := make(map[string]interface{})
+	for _, param := range SQLParams(note.Data) {
+		value, err := ScanString("enter :" + param + ": ")
+		if err != nil {
+			ClientErrorMsg(err)
+		}
+		values[param] = ParamValue(value)
+	}
+
+	return RunQuery(db, note.Data, sqlNamedArgs(values), format, os.Stdout)
 }
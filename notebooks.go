@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Notebook struct {
+	Id          int
+	UserId      int    `db:"user_id" json:"user_id"`
+	WorkspaceId *int   `db:"workspace_id" json:"workspace_id,omitempty"`
+	ParentId    *int   `db:"parent_id" json:"parent_id,omitempty"`
+	Name        string `db:"name" json:"name"`
+}
+
+// IdPtr returns the id to be stored in notebook_id and parent_id columns,
+// nil stands for the root notebook.
+func (notebook *Notebook) IdPtr() *int {
+	if notebook == nil {
+		return nil
+	}
+
+	id := notebook.Id
+	return &id
+}
+
+// SplitNotebookPath splits a slash separated notebook path into names,
+// the root is an empty path.
+func SplitNotebookPath(path string) ([]string, error) {
+	path = strings.Trim(strings.TrimSpace(path), "/")
+	if path == "" {
+		return nil, nil
+	}
+
+	names := strings.Split(path, "/")
+	for _, name := range names {
+		if err := CheckNotebookName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+func CheckNotebookName(name string) error {
+	if strings.TrimSpace(name) != name || name == "" || name == "." || name == ".." {
+		return fmt.Errorf("wrong notebook name \"%s\"", name)
+	}
+
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("notebook name \"%s\" must not contain slashes", name)
+	}
+
+	return nil
+}
+
+func (user *User) getChildNotebook(db sqlx.Queryer, parent_id *int, name string) (*Notebook, error) {
+	notebook := new(Notebook)
+
+	where, args := user.Scope().Where("")
+	err := sqlx.Get(db, notebook, "select * from notebooks where "+where+" and parent_id is ? and name=?",
+		append(args, parent_id, name)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return notebook, nil
+}
+
+// GetNotebookByPath returns the notebook at path in the active scope, for
+// the root it returns nil without an error.
+func (user *User) GetNotebookByPath(db sqlx.Queryer, path string) (*Notebook, error) {
+	names, err := SplitNotebookPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var notebook *Notebook
+	for i, name := range names {
+		notebook, err = user.getChildNotebook(db, notebook.IdPtr(), name)
+		if err != nil {
+			return nil, fmt.Errorf("notebook \"%s\" not found", strings.Join(names[:i+1], "/"))
+		}
+	}
+
+	return notebook, nil
+}
+
+// CreateNotebook creates the notebook at path together with all its
+// missing parents.
+func (user *User) CreateNotebook(db *sqlx.DB, path string) error {
+	names, err := SplitNotebookPath(path)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("notebook path is empty")
+	}
+
+	if err = user.RequireScopePermission(db, PermWrite); err != nil {
+		return err
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	var notebook *Notebook
+	created := false
+	for _, name := range names {
+		child, err := user.getChildNotebook(tx, notebook.IdPtr(), name)
+		if err == nil {
+			notebook = child
+			continue
+		}
+
+		res, err := tx.Exec("insert into notebooks (user_id, workspace_id, parent_id, name) values (?, ?, ?, ?)",
+			user.Id, user.Workspace.IdPtr(), notebook.IdPtr(), name)
+		if err != nil {
+			return err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		notebook = &Notebook{Id: int(id), UserId: user.Id, WorkspaceId: user.Workspace.IdPtr(), ParentId: notebook.IdPtr(), Name: name}
+		created = true
+	}
+
+	if !created {
+		return fmt.Errorf("notebook \"%s\" already exists", path)
+	}
+
+	return tx.Commit()
+}
+
+func (user *User) RenameNotebook(db *sqlx.DB, path, name string) error {
+	if err := CheckNotebookName(name); err != nil {
+		return err
+	}
+
+	if err := user.RequireScopePermission(db, PermWrite); err != nil {
+		return err
+	}
+
+	notebook, err := user.GetNotebookByPath(db, path)
+	if err != nil {
+		return err
+	}
+
+	if notebook == nil {
+		return fmt.Errorf("root notebook can't be renamed")
+	}
+
+	if _, err = user.getChildNotebook(db, notebook.ParentId, name); err == nil {
+		return fmt.Errorf("notebook \"%s\" already exists", name)
+	}
+
+	_, err = db.Exec("update notebooks set name=? where id=?", name, notebook.Id)
+	return err
+}
+
+// MoveNotebook makes the notebook at path a child of the notebook at
+// parent_path.
+func (user *User) MoveNotebook(db *sqlx.DB, path, parent_path string) error {
+	if err := user.RequireScopePermission(db, PermWrite); err != nil {
+		return err
+	}
+
+	notebook, err := user.GetNotebookByPath(db, path)
+	if err != nil {
+		return err
+	}
+
+	if notebook == nil {
+		return fmt.Errorf("root notebook can't be moved")
+	}
+
+	parent, err := user.GetNotebookByPath(db, parent_path)
+	if err != nil {
+		return err
+	}
+
+	// walk up from the new parent to make sure it isn't inside the notebook
+	for id := parent.IdPtr(); id != nil; {
+		if *id == notebook.Id {
+			return fmt.Errorf("notebook can't be moved into itself")
+		}
+
+		if err = db.Get(&id, "select parent_id from notebooks where id=?", *id); err != nil {
+			return err
+		}
+	}
+
+	if _, err = user.getChildNotebook(db, parent.IdPtr(), notebook.Name); err == nil {
+		return fmt.Errorf("notebook \"%s\" already exists there", notebook.Name)
+	}
+
+	_, err = db.Exec("update notebooks set parent_id=? where id=?", parent.IdPtr(), notebook.Id)
+	return err
+}
+
+// DeleteNotebook removes an empty notebook, notes of it which are in the
+// trash will be restored to the root.
+func (user *User) DeleteNotebook(db *sqlx.DB, path string) error {
+	if err := user.RequireScopePermission(db, PermWrite); err != nil {
+		return err
+	}
+
+	notebook, err := user.GetNotebookByPath(db, path)
+	if err != nil {
+		return err
+	}
+
+	if notebook == nil {
+		return fmt.Errorf("root notebook can't be deleted")
+	}
+
+	var count int
+	err = db.Get(&count, `select (select count(*) from notebooks where parent_id=$1) +
+		(select count(*) from notes where notebook_id=$1 and deleted_at is null)`, notebook.Id)
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("notebook \"%s\" is not empty", path)
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("update notes set notebook_id=null where notebook_id=?", notebook.Id); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("delete from shares where notebook_id=?", notebook.Id); err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec("delete from notebooks where id=?", notebook.Id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ListNotebook returns names of child notebooks and notes of the notebook
+// at path.
+func (user *User) ListNotebook(db *sqlx.DB, path string) ([]string, []Note, error) {
+	notebook, err := user.GetNotebookByPath(db, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	where, args := user.Scope().Where("")
+
+	names := make([]string, 0)
+	err = db.Select(&names, "select name from notebooks where "+where+" and parent_id is ? order by name",
+		append(args, notebook.IdPtr())...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notes := make([]Note, 0)
+	err = db.Select(&notes, "select * from notes where "+where+" and notebook_id is ? and deleted_at is null order by pinned desc, title",
+		append(args, notebook.IdPtr())...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, nil, err
+	}
+
+	if EncryptedAtRest() {
+		SortByTitle(notes)
+	}
+
+	return names, notes, nil
+}
+
+// MoveNoteById moves the note into the notebook at path.
+func (user *User) MoveNoteById(db *sqlx.DB, note_id int, path string) error {
+	note, err := user.GetNoteWithPermission(db, note_id, PermOwner)
+	if err != nil {
+		return err
+	}
+
+	// notebooks are looked up in the active scope
+	if !NoteScope(note).Equal(user.Scope()) {
+		return fmt.Errorf("note %d is not in the active workspace", note_id)
+	}
+
+	notebook, err := user.GetNotebookByPath(db, path)
+	if err != nil {
+		return err
+	}
+
+	exists, err := NoteTitleExists(db, user.Scope(), note.Title, notebook.IdPtr(), note.Id)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return fmt.Errorf("note with \"%s\" name already exists there", note.Title)
+	}
+
+	_, err = db.Exec("update notes set notebook_id=? where id=?", notebook.IdPtr(), note.Id)
+	return err
+}
+
+// LoadNotebookPaths fills in the Notebook field of every note in notes.
+func LoadNotebookPaths(db DB, notes []Note) error {
+	ids := make([]int, 0)
+	for _, note := range notes {
+		if note.NotebookId != nil {
+			ids = append(ids, *note.NotebookId)
+		}
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// the notebooks of the notes together with all their parents
+	query, args, err := sqlx.In(`with recursive chain(id) as (
+			select id from notebooks where id in (?)
+			union
+			select nb.parent_id from notebooks nb join chain c on nb.id=c.id where nb.parent_id is not null
+		)
+		select * from notebooks where id in (select id from chain)`, ids)
+	if err != nil {
+		return err
+	}
+
+	notebooks := make([]Notebook, 0)
+	if err = db.Select(&notebooks, db.Rebind(query), args...); err != nil {
+		return err
+	}
+
+	index := make(map[int]Notebook, len(notebooks))
+	for _, notebook := range notebooks {
+		index[notebook.Id] = notebook
+	}
+
+	for i := range notes {
+		var names []string
+		for id := notes[i].NotebookId; id != nil && len(names) <= len(index); {
+			notebook, ok := index[*id]
+			if !ok {
+				break
+			}
+
+			names = append([]string{notebook.Name}, names...)
+			id = notebook.ParentId
+		}
+
+		notes[i].Notebook = strings.Join(names, "/")
+	}
+
+	return nil
+}
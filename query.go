@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A filter query is a list of terms separated by spaces, a note matches
+// it when it matches every term:
+//
+//	word "some phrase"     title or query contains the text
+//	title:x  body:x        title or query contains x
+//	tag:x                  note has the tag x
+//	lang:x                 query is written in language x
+//	kind:x                 note is of kind x
+//	is:pinned  is:favorite note is pinned or a favorite of the user
+//	created:>2026-01-01    creation or update date compared with
+//	updated:<=2026-01-01   >, >=, <, <= or = (the default)
+//	-term                  note doesn't match term
+type QueryTerm struct {
+	Pos    int
+	Token  string
+	Negate bool
+	Field  string
+	Op     string
+	Value  string
+}
+
+type QueryError struct {
+	Pos     int
+	Token   string
+	Message string
+}
+
+func (err *QueryError) Error() string {
+	return fmt.Sprintf("at position %d (%s): %s", err.Pos+1, err.Token, err.Message)
+}
+
+var queryFields = map[string]bool{
+	"title":   true,
+	"body":    true,
+	"tag":     true,
+	"lang":    true,
+	"kind":    true,
+	"is":      true,
+	"created": true,
+	"updated": true,
+}
+
+// queryDateFormats are the layouts of dates in queries with the end of
+// the day, minute or second a date covers.
+var queryDateFormats = []struct {
+	layout string
+	end    func(time.Time) time.Time
+}{
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01-02 15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02T15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02 15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+// ParseQuery splits a filter query into terms.
+func ParseQuery(query string) ([]QueryTerm, error) {
+	terms := make([]QueryTerm, 0)
+
+	for i := 0; i < len(query); {
+		if query[i] == ' ' || query[i] == '\t' {
+			i++
+			continue
+		}
+
+		term := QueryTerm{Pos: i}
+		start := i
+
+		if query[i] == '-' {
+			term.Negate = true
+			i++
+		}
+
+		// a field name is only recognized before a colon
+		j := i
+		for j < len(query) && isQueryFieldChar(query[j]) {
+			j++
+		}
+
+		if j < len(query) && query[j] == ':' && j > i {
+			term.Field = strings.ToLower(query[i:j])
+			i = j + 1
+
+			if !queryFields[term.Field] {
+				return nil, &QueryError{Pos: start, Token: query[start:j], Message: fmt.Sprintf("unknown field \"%s\"", term.Field)}
+			}
+
+			for _, op := range []string{">=", "<=", ">", "<", "="} {
+				if strings.HasPrefix(query[i:], op) {
+					term.Op = op
+					i += len(op)
+					break
+				}
+			}
+		}
+
+		value, next, err := scanQueryValue(query, i)
+		if err != nil {
+			return nil, err
+		}
+		i = next
+
+		term.Value = value
+		term.Token = query[start:i]
+
+		if term.Value == "" {
+			return nil, &QueryError{Pos: start, Token: term.Token, Message: "value is empty"}
+		}
+
+		if term.Op != "" && term.Field != "created" && term.Field != "updated" {
+			return nil, &QueryError{Pos: start, Token: term.Token, Message: fmt.Sprintf("field \"%s\" can't be compared", term.Field)}
+		}
+
+		if term.Field == "kind" {
+			if err := CheckNoteKind(strings.ToLower(term.Value)); err != nil {
+				return nil, &QueryError{Pos: start, Token: term.Token, Message: err.Error()}
+			}
+		}
+
+		if term.Field == "is" {
+			term.Value = strings.ToLower(term.Value)
+			if term.Value != "pinned" && term.Value != "favorite" {
+				return nil, &QueryError{Pos: start, Token: term.Token, Message: "use is:pinned or is:favorite"}
+			}
+		}
+
+		if term.Field == "lang" {
+			if _, err := NormalizeLanguage(term.Value); err != nil {
+				return nil, &QueryError{Pos: start, Token: term.Token, Message: err.Error()}
+			}
+		}
+
+		if term.Field == "created" || term.Field == "updated" {
+			if term.Op == "" {
+				term.Op = "="
+			}
+
+			if _, _, err := parseQueryDate(term.Value); err != nil {
+				return nil, &QueryError{Pos: start, Token: term.Token, Message: "wrong date, use YYYY-MM-DD or \"YYYY-MM-DD HH:MM\""}
+			}
+		}
+
+		terms = append(terms, term)
+	}
+
+	if len(terms) == 0 {
+		return nil, &QueryError{Pos: 0, Token: query, Message: "query is empty"}
+	}
+
+	return terms, nil
+}
+
+func isQueryFieldChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+// scanQueryValue reads a bare or double quoted value starting at i and
+// returns it with the position after it.
+func scanQueryValue(query string, i int) (string, int, error) {
+	if i >= len(query) || query[i] != '"' {
+		j := i
+		for j < len(query) && query[j] != ' ' && query[j] != '\t' {
+			if query[j] == '"' {
+				return "", 0, &QueryError{Pos: j, Token: query[i : j+1], Message: "unexpected quote"}
+			}
+			j++
+		}
+
+		return query[i:j], j, nil
+	}
+
+	var b strings.Builder
+	for j := i + 1; j < len(query); j++ {
+		switch {
+		case query[j] == '\\' && j+1 < len(query):
+			j++
+			b.WriteByte(query[j])
+		case query[j] == '"':
+			if j+1 < len(query) && query[j+1] != ' ' && query[j+1] != '\t' {
+				return "", 0, &QueryError{Pos: j + 1, Token: query[i : j+2], Message: "expected space after quoted value"}
+			}
+
+			return b.String(), j + 1, nil
+		default:
+			b.WriteByte(query[j])
+		}
+	}
+
+	return "", 0, &QueryError{Pos: i, Token: query[i:], Message: "unterminated quote"}
+}
+
+// parseQueryDate returns the start and the end of the local time a date in
+// a query covers.
+func parseQueryDate(value string) (time.Time, time.Time, error) {
+	for _, format := range queryDateFormats {
+		if t, err := time.ParseInLocation(format.layout, value, time.Local); err == nil {
+			return t, format.end(t), nil
+		}
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("wrong date")
+}
+
+// CompileQuery turns terms into a condition on the notes table aliased as n,
+// values are never put into the condition itself but returned as args.
+// is:favorite matches the favorites of the user with user_id.
+func CompileQuery(terms []QueryTerm, user_id int) (string, []interface{}) {
+	conditions := make([]string, 0, len(terms))
+	args := make([]interface{}, 0, len(terms))
+
+	for _, term := range terms {
+		var condition string
+
+		switch term.Field {
+		case "":
+			condition = `(n.title like ? escape '\' or ` + noteBody("n.") + ` like ? escape '\')`
+			args = append(args, likePattern(term.Value), likePattern(term.Value))
+		case "title":
+			condition = `n.title like ? escape '\'`
+			args = append(args, likePattern(term.Value))
+		case "body":
+			condition = noteBody("n.") + ` like ? escape '\'`
+			args = append(args, likePattern(term.Value))
+		case "tag":
+			condition = `exists (select 1 from note_tags nt join tags t on t.id=nt.tag_id
+				where nt.note_id=n.id and t.name=?)`
+			args = append(args, strings.ToLower(term.Value))
+		case "kind":
+			condition = "n.kind=?"
+			args = append(args, strings.ToLower(term.Value))
+		case "is":
+			// the value is checked by ParseQuery
+			if term.Value == "favorite" {
+				condition = "exists (select 1 from favorites f where f.note_id=n.id and f.user_id=?)"
+				args = append(args, user_id)
+			} else {
+				condition = "n.pinned=1"
+			}
+		case "lang":
+			lang, _ := NormalizeLanguage(term.Value)
+			condition = "n.language=?"
+			args = append(args, lang)
+		case "created", "updated":
+			condition, args = compileDateTerm(term, args)
+		}
+
+		if term.Negate {
+			condition = "not " + condition
+		}
+
+		conditions = append(conditions, condition)
+	}
+
+	return strings.Join(conditions, " and "), args
+}
+
+func compileDateTerm(term QueryTerm, args []interface{}) (string, []interface{}) {
+	column := "n.created_at"
+	if term.Field == "updated" {
+		column = "n.updated_at"
+	}
+
+	start, end, _ := parseQueryDate(term.Value)
+
+	// dates are stored in UTC, a date in the query covers a whole day,
+	// minute or second of local time
+	from := start.UTC().Format("2006-01-02 15:04:05")
+	to := end.UTC().Format("2006-01-02 15:04:05")
+
+	switch term.Op {
+	case ">":
+		return column + ">=?", append(args, to)
+	case ">=":
+		return column + ">=?", append(args, from)
+	case "<":
+		return column + "<?", append(args, from)
+	case "<=":
+		return column + "<?", append(args, to)
+	default:
+		return "(" + column + ">=? and " + column + "<?)", append(args, from, to)
+	}
+}
+
+func likePattern(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+	return "%" + value + "%"
+}
+
+// IsTextTerm reports whether term is matched against the title or query
+// of a note rather than its tags or dates.
+func (term QueryTerm) IsTextTerm() bool {
+	return term.Field == "" || term.Field == "title" || term.Field == "body"
+}
+
+// MatchNote matches a text term against note the way CompileQuery does it
+// in SQL, for notes whose text the server can't read.
+func (term QueryTerm) MatchNote(note Note) bool {
+	value := strings.ToLower(term.Value)
+	title := strings.Contains(strings.ToLower(note.Title), value)
+	body := strings.Contains(strings.ToLower(note.Data), value)
+
+	matched := title || body
+	switch term.Field {
+	case "title":
+		matched = title
+	case "body":
+		matched = body
+	}
+
+	return matched != term.Negate
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		terms []QueryTerm
+	}{
+		{"docker", []QueryTerm{{Pos: 0, Token: "docker", Value: "docker"}}},
+		{"-docker", []QueryTerm{{Pos: 0, Token: "-docker", Negate: true, Value: "docker"}}},
+		{`"select 1"  -tag:old`, []QueryTerm{
+			{Pos: 0, Token: `"select 1"`, Value: "select 1"},
+			{Pos: 12, Token: "-tag:old", Negate: true, Field: "tag", Value: "old"},
+		}},
+		{`-title:"a \"b\""`, []QueryTerm{{Pos: 0, Token: `-title:"a \"b\""`, Negate: true, Field: "title", Value: `a "b"`}}},
+		{"-is:Pinned", []QueryTerm{{Pos: 0, Token: "-is:Pinned", Negate: true, Field: "is", Value: "pinned"}}},
+		{"created:>=2026-01-01", []QueryTerm{{Pos: 0, Token: "created:>=2026-01-01", Field: "created", Op: ">=", Value: "2026-01-01"}}},
+		{"-updated:2026-01-01", []QueryTerm{{Pos: 0, Token: "-updated:2026-01-01", Negate: true, Field: "updated", Op: "=", Value: "2026-01-01"}}},
+		{"a:b:c", nil},
+		{"url:http://x", nil},
+		{"-", nil},
+		{"-tag:", nil},
+		{`"open`, nil},
+		{`"a"b`, nil},
+		{"a\"b", nil},
+		{"is:secret", nil},
+		{"kind:nope", nil},
+		{"tag:>x", nil},
+		{"created:yesterday", nil},
+		{"  ", nil},
+	}
+
+	for _, test := range tests {
+		terms, err := ParseQuery(test.query)
+		if test.terms == nil {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) = %+v, want an error", test.query, terms)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %s", test.query, err)
+		} else if !reflect.DeepEqual(terms, test.terms) {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", test.query, terms, test.terms)
+		}
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	tests := []struct {
+		query     string
+		condition []string
+		args      []interface{}
+	}{
+		{"tag:Go", []string{"exists (select 1 from note_tags"}, []interface{}{"go"}},
+		{"-tag:go", []string{"not exists (select 1 from note_tags"}, []interface{}{"go"}},
+		{"-kind:secret", []string{"not n.kind=?"}, []interface{}{"secret"}},
+		{"-title:50%", []string{`not n.title like ? escape '\'`}, []interface{}{`%50\%%`}},
+		{"-x_y", []string{"not (n.title like ?"}, []interface{}{`%x\_y%`, `%x\_y%`}},
+		{"is:pinned -is:favorite", []string{"n.pinned=1", "not exists (select 1 from favorites f"}, []interface{}{7}},
+		{"kind:plain -body:x", []string{"n.kind=?", "not ifnull("}, []interface{}{"plain", "%x%"}},
+	}
+
+	for _, test := range tests {
+		terms, err := ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %s", test.query, err)
+			continue
+		}
+
+		if len(terms) != len(test.condition) {
+			t.Errorf("ParseQuery(%q) = %+v, want %d terms", test.query, terms, len(test.condition))
+			continue
+		}
+
+		for i, term := range terms {
+			condition, _ := CompileQuery([]QueryTerm{term}, 7)
+			if !strings.HasPrefix(condition, test.condition[i]) {
+				t.Errorf("CompileQuery(%q) = %q, want it to start with %q", term.Token, condition, test.condition[i])
+			}
+		}
+
+		_, args := CompileQuery(terms, 7)
+		if !reflect.DeepEqual(args, test.args) {
+			t.Errorf("CompileQuery(%q) args = %#v, want %#v", test.query, args, test.args)
+		}
+	}
+}
+
+func TestCompileDateTerm(t *testing.T) {
+	// dates in queries are local, a day crossing a DST change isn't 24
+	// hours long
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := time.Local
+	time.Local = loc
+	defer func() { time.Local = local }()
+
+	tests := []struct {
+		query     string
+		condition string
+		args      []interface{}
+	}{
+		{`updated:"2026-01-01 10:00:30"`, "(n.updated_at>=? and n.updated_at<?)", []interface{}{"2026-01-01 15:00:30", "2026-01-01 15:00:31"}},
+		{`updated:>"2026-01-01 10:00:30"`, "n.updated_at>=?", []interface{}{"2026-01-01 15:00:31"}},
+		{`updated:<"2026-01-01 10:00:30"`, "n.updated_at<?", []interface{}{"2026-01-01 15:00:30"}},
+		{`created:"2026-01-01 10:00"`, "(n.created_at>=? and n.created_at<?)", []interface{}{"2026-01-01 15:00:00", "2026-01-01 15:01:00"}},
+		{"created:<=2026-01-01T10:00", "n.created_at<?", []interface{}{"2026-01-01 15:01:00"}},
+		{"created:>=2026-01-01", "n.created_at>=?", []interface{}{"2026-01-01 05:00:00"}},
+		{"created:2026-03-08", "(n.created_at>=? and n.created_at<?)", []interface{}{"2026-03-08 05:00:00", "2026-03-09 04:00:00"}},
+		{"created:>2026-11-01", "n.created_at>=?", []interface{}{"2026-11-02 05:00:00"}},
+		{"-updated:<=2026-11-01", "not n.updated_at<?", []interface{}{"2026-11-02 05:00:00"}},
+	}
+
+	for _, test := range tests {
+		terms, err := ParseQuery(test.query)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) failed: %s", test.query, err)
+			continue
+		}
+
+		condition, args := CompileQuery(terms, 7)
+		if condition != test.condition || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("CompileQuery(%q) = %q %q, want %q %q", test.query, condition, args, test.condition, test.args)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Quotas limit what a single user may store, 0 means no limit. Notes in
+// the trash, checklist items and attachments count too, everything is
+// counted as stored, so encrypted notes take more space.
+type Quotas struct {
+	MaxNotes    int   `json:"max_notes"`
+	MaxBytes    int64 `json:"max_bytes"`
+	MaxNoteSize int   `json:"max_note_size"`
+}
+
+// quotas are the limits of the server.
+var quotas Quotas
+
+// Usage is what a user stores and the quotas of the server.
+type Usage struct {
+	Notes       int   `db:"notes" json:"notes"`
+	Bytes       int64 `db:"bytes" json:"bytes"`
+	Attachments int   `db:"attachments" json:"attachments"`
+	Quotas
+}
+
+// NoteSize is the size of the title and query of note as sent by the
+// client.
+func NoteSize(note *Note) int {
+	return len(note.Title) + len(note.Data)
+}
+
+// CheckNoteSize refuses notes which with the items of a checklist are
+// larger than the max_note_size of the server.
+func CheckNoteSize(note *Note) error {
+	size := NoteSize(note)
+	for _, item := range note.Items {
+		size += len(item.Text)
+	}
+
+	if quotas.MaxNoteSize > 0 && size > quotas.MaxNoteSize {
+		return fmt.Errorf("note is %d bytes, notes can't be larger than %d bytes", size, quotas.MaxNoteSize)
+	}
+
+	return nil
+}
+
+// GetUsage returns what the notes the user created, in all scopes, and
+// their attachments take.
+func (user *User) GetUsage(db sqlx.Queryer) (*Usage, error) {
+	usage := &Usage{Quotas: quotas}
+
+	err := sqlx.Get(db, usage, `select count(*) as notes,
+		ifnull(sum(length(cast(title as blob))+`+noteBodySize("")+`), 0) as bytes,
+		0 as attachments from notes where user_id=?`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments struct {
+		Count int   `db:"count"`
+		Size  int64 `db:"size"`
+	}
+	err = sqlx.Get(db, &attachments, `select count(*) as count, ifnull(sum(a.size), 0) as size
+		from attachments a join notes n on n.id=a.note_id where n.user_id=?`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var items int64
+	err = sqlx.Get(db, &items, `select ifnull(sum(length(cast(i.text as blob))), 0)
+		from checklist_items i join notes n on n.id=i.note_id where n.user_id=?`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	usage.Attachments = attachments.Count
+	usage.Bytes += attachments.Size + items
+	return usage, nil
+}
+
+// CheckQuota fails when the user would exceed the quotas after adding
+// notes and bytes, which may be negative.
+func (user *User) CheckQuota(db sqlx.Queryer, notes int, bytes int64) error {
+	if quotas.MaxNotes == 0 && quotas.MaxBytes == 0 {
+		return nil
+	}
+
+	usage, err := user.GetUsage(db)
+	if err != nil {
+		return err
+	}
+
+	if quotas.MaxNotes > 0 && notes > 0 && usage.Notes+notes > quotas.MaxNotes {
+		return fmt.Errorf("quota exceeded: you have %d of %d notes, delete some and empty the trash",
+			usage.Notes, quotas.MaxNotes)
+	}
+
+	if quotas.MaxBytes > 0 && bytes > 0 && usage.Bytes+bytes > quotas.MaxBytes {
+		return fmt.Errorf("quota exceeded: you use %s of %s, %s more is needed",
+			FormatBytes(usage.Bytes), FormatBytes(quotas.MaxBytes), FormatBytes(usage.Bytes+bytes-quotas.MaxBytes))
+	}
+
+	return nil
+}
+
+func FormatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+
+	return fmt.Sprintf("%d bytes", n)
+}
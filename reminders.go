@@ -0,0 +1,372 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Reminder is a time a user wants to be reminded of a note at. Repeat is
+// empty for a single reminder, otherwise it is daily, weekly, monthly,
+// yearly or a cron expression and DueAt is the next time it is due.
+type Reminder struct {
+	Id        int       `db:"id" json:"id"`
+	NoteId    int       `db:"note_id" json:"note_id"`
+	UserId    int       `db:"user_id" json:"-"`
+	DueAt     time.Time `db:"due_at" json:"due_at"`
+	Repeat    string    `db:"repeat" json:"repeat,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+
+	// Title is the title of the note, as stored for notes encrypted
+	// end-to-end.
+	Title string `db:"-" json:"title,omitempty"`
+}
+
+// cronSchedule is a parsed cron expression, every field is a set of the
+// values it matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps like */15 or 1-5/2 between min and max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("wrong step in \"%s\"", field)
+			}
+			step, part = n, part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("wrong value in \"%s\"", field)
+			}
+
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("wrong value in \"%s\"", field)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("\"%s\" is out of range %d-%d", field, min, max)
+		}
+
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// parseCron parses the five fields minute, hour, day of month, month and
+// day of week (0 or 7 is Sunday) of a cron expression. Like cron a day
+// matches when either day field does if both are restricted.
+func parseCron(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression needs 5 fields: minute hour day month weekday")
+	}
+
+	var err error
+	cron := &cronSchedule{anyDom: fields[2] == "*", anyDow: fields[4] == "*"}
+	if cron.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if cron.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if cron.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if cron.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if cron.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+
+	if cron.dow&(1<<7) != 0 {
+		cron.dow |= 1
+	}
+
+	return cron, nil
+}
+
+func (cron *cronSchedule) matchDay(t time.Time) bool {
+	dom := cron.dom&(1<<uint(t.Day())) != 0
+	dow := cron.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case cron.anyDom && cron.anyDow:
+		return true
+	case cron.anyDom:
+		return dow
+	case cron.anyDow:
+		return dom
+	}
+
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule matches, in the time
+// zone of t, or the zero time if there is none within five years.
+func (cron *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+
+	for t.Before(end) {
+		switch {
+		case cron.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !cron.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case cron.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case cron.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// CheckRepeat checks that repeat is empty, daily, weekly, monthly, yearly
+// or a cron expression.
+func CheckRepeat(repeat string) error {
+	switch repeat {
+	case "", "daily", "weekly", "monthly", "yearly":
+		return nil
+	}
+
+	if _, err := parseCron(repeat); err != nil {
+		return fmt.Errorf("wrong repeat \"%s\": %s", repeat, err)
+	}
+
+	return nil
+}
+
+// NextDue returns when a reminder due at due with repeat is due next after
+// now, repeats keep the time of day in the time zone of the server. It
+// returns the zero time if it is not due again.
+func NextDue(repeat string, due, now time.Time) time.Time {
+	step := func(t time.Time) time.Time { return time.Time{} }
+
+	switch repeat {
+	case "":
+	case "daily":
+		step = func(t time.Time) time.Time { return t.Local().AddDate(0, 0, 1).UTC() }
+	case "weekly":
+		step = func(t time.Time) time.Time { return t.Local().AddDate(0, 0, 7).UTC() }
+	case "monthly":
+		step = func(t time.Time) time.Time { return t.Local().AddDate(0, 1, 0).UTC() }
+	case "yearly":
+		step = func(t time.Time) time.Time { return t.Local().AddDate(1, 0, 0).UTC() }
+	default:
+		cron, err := parseCron(repeat)
+		if err != nil {
+			return time.Time{}
+		}
+		step = func(t time.Time) time.Time { return cron.next(t.Local()).UTC() }
+	}
+
+	// reminders missed while nobody was connected are skipped
+	for next := step(due); !next.IsZero(); next = step(next) {
+		if next.After(now) {
+			return next
+		}
+	}
+
+	return time.Time{}
+}
+
+// ParseDueTime parses when a reminder is due relative to now: a date with
+// an optional time (9:00 without), a time today or tomorrow if it has
+// passed, or a duration from now like +30m, +2h or +3d.
+func ParseDueTime(when string, now time.Time) (time.Time, error) {
+	when = strings.TrimSpace(when)
+
+	if strings.HasPrefix(when, "+") {
+		if strings.HasSuffix(when, "d") {
+			n, err := strconv.Atoi(when[1 : len(when)-1])
+			if err != nil || n < 0 {
+				return time.Time{}, fmt.Errorf("wrong number of days \"%s\"", when)
+			}
+			return now.AddDate(0, 0, n), nil
+		}
+
+		d, err := time.ParseDuration(when[1:])
+		if err != nil || d < 0 {
+			return time.Time{}, fmt.Errorf("wrong duration \"%s\", use e.g. +30m, +2h or +3d", when)
+		}
+		return now.Add(d), nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02 15:04", when, now.Location()); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", when, now.Location()); err == nil {
+		return t.Add(9 * time.Hour), nil
+	}
+
+	if t, err := time.ParseInLocation("15:04", when, now.Location()); err == nil {
+		due := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+		if !due.After(now) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due, nil
+	}
+
+	return time.Time{}, fmt.Errorf("wrong time \"%s\", use YYYY-MM-DD [HH:MM], HH:MM or +duration", when)
+}
+
+// SetReminder sets when the user is reminded of a note the user can read,
+// replacing the reminder the user had for it. Reminders without DueAt are
+// due when repeat is next due.
+func (user *User) SetReminder(db *sqlx.DB, reminder Reminder) (*Reminder, error) {
+	note, err := user.GetNoteById(db, reminder.NoteId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = CheckRepeat(reminder.Repeat); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	reminder.DueAt = reminder.DueAt.UTC().Truncate(time.Minute)
+	if reminder.DueAt.IsZero() {
+		if reminder.Repeat == "" {
+			return nil, fmt.Errorf("enter when the reminder is due")
+		}
+
+		reminder.DueAt = NextDue(reminder.Repeat, now, now)
+		if reminder.DueAt.IsZero() {
+			return nil, fmt.Errorf("\"%s\" is never due", reminder.Repeat)
+		}
+	} else if reminder.Repeat == "" && !reminder.DueAt.After(now) {
+		return nil, fmt.Errorf("reminder is in the past")
+	}
+
+	reminder.NoteId = note.Id
+	reminder.UserId = user.Id
+	reminder.Title = note.Title
+
+	_, err = db.NamedExec(`insert into reminders (note_id, user_id, due_at, repeat, created_at)
+		values (:note_id, :user_id, :due_at, :repeat, CURRENT_TIMESTAMP)
+		on conflict (note_id, user_id) do update set due_at=excluded.due_at, repeat=excluded.repeat`, reminder)
+	if err != nil {
+		return nil, err
+	}
+
+	return &reminder, nil
+}
+
+func (user *User) DeleteReminder(db *sqlx.DB, note_id int) error {
+	res, err := db.Exec("delete from reminders where note_id=? and user_id=?", note_id, user.Id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("note %d has no reminder", note_id)
+	}
+
+	return nil
+}
+
+// GetReminders returns the reminders of the user by when they are due
+// next, reminders of notes in the trash or which the user can no longer
+// read are left out.
+func (user *User) GetReminders(db *sqlx.DB) ([]Reminder, error) {
+	reminders := make([]Reminder, 0)
+	if err := db.Select(&reminders, "select * from reminders where user_id=? order by due_at", user.Id); err != nil {
+		return nil, err
+	}
+
+	readable := reminders[:0]
+	for _, reminder := range reminders {
+		note, err := user.GetNoteById(db, reminder.NoteId)
+		if err != nil {
+			continue
+		}
+
+		reminder.Title = note.Title
+		readable = append(readable, reminder)
+	}
+
+	return readable, nil
+}
+
+// DeliverReminders sends the reminders due at now to the sessions of
+// their users. Reminders of users who are not connected wait until they
+// connect, then single reminders are removed and repeating ones are moved
+// to when they are due next. It returns how many were delivered.
+func DeliverReminders(db *sqlx.DB, now time.Time) (int, error) {
+	reminders := make([]Reminder, 0)
+	if err := db.Select(&reminders, "select * from reminders where due_at<=? order by due_at", now.UTC()); err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, reminder := range reminders {
+		if !sessions.Online(reminder.UserId) {
+			continue
+		}
+
+		user := User{Id: reminder.UserId}
+		note, err := user.GetNoteById(db, reminder.NoteId)
+		if err != nil {
+			// a note in the trash may come back
+			var trashed bool
+			if db.Get(&trashed, "select deleted_at is not null from notes where id=?", reminder.NoteId) == nil && trashed {
+				continue
+			}
+
+			if _, err = db.Exec("delete from reminders where id=?", reminder.Id); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		reminder.Title = note.Title
+
+		if sessions.Notify(reminder.UserId, NotifyT, reminder) == 0 {
+			continue
+		}
+		delivered++
+
+		next := NextDue(reminder.Repeat, reminder.DueAt, now.UTC())
+		if next.IsZero() {
+			_, err = db.Exec("delete from reminders where id=?", reminder.Id)
+		} else {
+			_, err = db.Exec("update reminders set due_at=? where id=?", next, reminder.Id)
+		}
+		if err != nil {
+			return delivered, err
+		}
+	}
+
+	return delivered, nil
+}
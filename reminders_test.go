@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0 0 1,15 * 0,7", true},
+		{"0 9 * *", false},
+		{"0 9 * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+		{"1- * * * *", false},
+	}
+
+	for _, test := range tests {
+		if _, err := parseCron(test.expr); (err == nil) != test.valid {
+			t.Errorf("parseCron(%q) error = %v, want valid %v", test.expr, err, test.valid)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	date := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		expr, from, next string
+	}{
+		{"*/15 * * * *", "2026-10-17 10:07", "2026-10-17 10:15"},
+		{"*/15 * * * *", "2026-10-17 10:15", "2026-10-17 10:30"},
+		{"0 9 * * 1-5", "2026-10-16 10:00", "2026-10-19 09:00"},
+
+		// a day matches either restricted day field
+		{"0 0 13 * 5", "2026-10-01 00:00", "2026-10-02 00:00"},
+		{"0 0 13 * 5", "2026-10-09 00:00", "2026-10-13 00:00"},
+		{"0 0 13 * 5", "2026-10-13 00:00", "2026-10-16 00:00"},
+		{"0 0 13 * *", "2026-10-01 00:00", "2026-10-13 00:00"},
+		{"0 0 * * 5", "2026-10-10 00:00", "2026-10-16 00:00"},
+		{"0 0 1 * 1", "2026-10-27 00:00", "2026-11-01 00:00"},
+
+		// 0 and 7 are both Sunday
+		{"30 8 * * 7", "2026-10-17 10:00", "2026-10-18 08:30"},
+		{"30 8 * * 0", "2026-10-17 10:00", "2026-10-18 08:30"},
+		{"0 0 * * 6-7", "2026-10-18 01:00", "2026-10-24 00:00"},
+		{"0 0 * * 5-7", "2026-10-18 01:00", "2026-10-23 00:00"},
+
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 31 4 *", "2026-01-01 00:00", ""},
+	}
+
+	for _, test := range tests {
+		cron, err := parseCron(test.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q) failed: %s", test.expr, err)
+			continue
+		}
+
+		if next := cron.next(date(test.from)); !next.Equal(date(test.next)) {
+			t.Errorf("%q after %s = %s, want %s", test.expr, test.from, next, test.next)
+		}
+	}
+}
+
+func TestNextDue(t *testing.T) {
+	// cron expressions are matched in the time zone of the server
+	date := func(s string) time.Time {
+		if s == "" {
+			return time.Time{}
+		}
+
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			panic(err)
+		}
+		return t.UTC()
+	}
+
+	tests := []struct {
+		repeat, due, now, next string
+	}{
+		{"", "2026-10-01 09:00", "2026-10-01 09:00", ""},
+		{"daily", "2026-10-01 09:00", "2026-10-01 09:00", "2026-10-02 09:00"},
+		{"daily", "2026-10-01 09:00", "2026-10-05 12:00", "2026-10-06 09:00"},
+		{"weekly", "2026-10-01 09:00", "2026-10-20 12:00", "2026-10-22 09:00"},
+		{"monthly", "2026-01-15 09:00", "2026-03-20 12:00", "2026-04-15 09:00"},
+		{"yearly", "2024-02-10 09:00", "2026-10-01 12:00", "2027-02-10 09:00"},
+		{"0 0 13 * 5", "2026-10-02 00:00", "2026-10-10 12:00", "2026-10-13 00:00"},
+		{"30 8 * * 7", "2026-10-11 08:30", "2026-10-17 10:00", "2026-10-18 08:30"},
+		{"0 9 * *", "2026-10-01 09:00", "2026-10-01 09:00", ""},
+	}
+
+	for _, test := range tests {
+		next := NextDue(test.repeat, date(test.due), date(test.now))
+		if !next.Equal(date(test.next)) {
+			t.Errorf("NextDue(%q, %s, %s) = %s, want %s", test.repeat, test.due, test.now, next, test.next)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// DataSource is a database SQL notes can be run against, Driver is one of
+// the registered database/sql drivers, sqlite3 by default.
+type DataSource struct {
+	Driver string `json:"driver"`
+	DSN    string `json:"dsn"`
+}
+
+// OpenDataSource connects to source, unless write is set changes to the
+// database are refused. Only sqlite3 can be opened read-only, other drivers
+// need write.
+func OpenDataSource(source DataSource, write bool) (*sqlx.DB, error) {
+	driver, dsn := source.Driver, source.DSN
+	if driver == "" {
+		driver = "sqlite3"
+	}
+
+	if driver != "sqlite3" && !write {
+		return nil, fmt.Errorf("%s data sources can't be opened read-only, run with --write", driver)
+	}
+
+	if driver == "sqlite3" && !write {
+		// sqlite would create a missing file instead of failing
+		path := strings.TrimPrefix(strings.SplitN(dsn, "?", 2)[0], "file:")
+		if path != ":memory:" {
+			if _, err := os.Stat(path); err != nil {
+				return nil, err
+			}
+		}
+
+		if strings.Contains(dsn, "?") {
+			dsn += "&_query_only=1"
+		} else {
+			dsn += "?_query_only=1"
+		}
+	}
+
+	return sqlx.Connect(driver, dsn)
+}
+
+// SQLParams returns the names of :name placeholders of query in the order
+// they first appear, strings and comments are skipped.
+func SQLParams(query string) []string {
+	seen := make(map[string]bool)
+	params := make([]string, 0)
+
+	for i := 0; i < len(query); i++ {
+		rest := query[i:]
+		switch {
+		case query[i] == '\'' || query[i] == '"':
+			i += quotedLen(rest) - 1
+		case strings.HasPrefix(rest, "--"):
+			i += lineEnd(rest)
+		case strings.HasPrefix(rest, "/*"):
+			if end := strings.Index(rest[2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(rest, "::"):
+			// a postgres cast, not a placeholder
+			i++
+		case query[i] == ':' && len(rest) > 1 && (isWordChar(rest[1]) && !(rest[1] >= '0' && rest[1] <= '9')):
+			n := wordLen(rest[1:])
+			name := rest[1 : 1+n]
+			if !seen[name] {
+				seen[name] = true
+				params = append(params, name)
+			}
+			i += n
+		}
+	}
+
+	return params
+}
+
+// ParamValue turns what was entered for a placeholder into a number when it
+// looks like one, "null" gives NULL.
+func ParamValue(value string) interface{} {
+	if strings.EqualFold(value, "null") {
+		return nil
+	}
+
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return i
+	}
+
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f
+	}
+
+	return value
+}
+
+// IsReadQuery reports whether query returns rows, judged by its first
+// keyword.
+func IsReadQuery(query string) bool {
+	for {
+		query = strings.TrimSpace(query)
+		switch {
+		case strings.HasPrefix(query, "--"):
+			query = query[lineEnd(query):]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return false
+			}
+			query = query[end+2:]
+		default:
+			word := strings.ToLower(query[:wordLen(query)])
+			return word == "select" || word == "with" || word == "pragma" || word == "explain" || word == "values"
+		}
+	}
+}
+
+// RunQuery runs query on db and writes its rows to w in format, which is
+// table, csv or json. Queries which don't return rows report how many rows
+// they changed.
+func RunQuery(db *sqlx.DB, query string, args []interface{}, format string, w io.Writer) error {
+	if !IsReadQuery(query) {
+		res, err := db.Exec(query, args...)
+
+		var sqlite_err sqlite3.Error
+		if errors.As(err, &sqlite_err) && sqlite_err.Code == sqlite3.ErrReadonly {
+			return fmt.Errorf("data source is opened read-only, run with --write to change it")
+		}
+		if err != nil {
+			return err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%d rows affected\n", n)
+		return err
+	}
+
+	rows, err := db.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	table := make([][]interface{}, 0)
+	for rows.Next() {
+		row, err := rows.SliceScan()
+		if err != nil {
+			return err
+		}
+		table = append(table, row)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	switch format {
+	case "csv":
+		return writeCSV(w, columns, table)
+	case "json":
+		return writeJSON(w, columns, table)
+	default:
+		return writeTable(w, columns, table)
+	}
+}
+
+// formatValue returns the text of a value scanned from a database, ok is
+// false for NULL.
+func formatValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case []byte:
+		return string(v), true
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05"), true
+	default:
+		return fmt.Sprint(v), true
+	}
+}
+
+func writeTable(w io.Writer, columns []string, table [][]interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+
+	for _, row := range table {
+		cells := make([]string, len(row))
+		for i, value := range row {
+			text, ok := formatValue(value)
+			if !ok {
+				text = "NULL"
+			}
+			// tabs and newlines would break the columns
+			cells[i] = strings.NewReplacer("\t", " ", "\n", " ").Replace(text)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "(%d rows)\n", len(table))
+	return err
+}
+
+func writeCSV(w io.Writer, columns []string, table [][]interface{}) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+
+	for _, row := range table {
+		record := make([]string, len(row))
+		for i, value := range row {
+			record[i], _ = formatValue(value)
+		}
+
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// writeJSON writes rows as an array of objects keeping the order of columns.
+func writeJSON(w io.Writer, columns []string, table [][]interface{}) error {
+	var b strings.Builder
+	b.WriteString("[")
+
+	for i, row := range table {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("\n  {")
+
+		for j, value := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+
+			key, err := json.Marshal(columns[j])
+			if err != nil {
+				return err
+			}
+
+			if bytes, ok := value.([]byte); ok {
+				value = string(bytes)
+			}
+
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+
+			b.Write(key)
+			b.WriteString(": ")
+			b.Write(data)
+		}
+
+		b.WriteString("}")
+	}
+
+	if len(table) > 0 {
+		b.WriteString("\n")
+	}
+	b.WriteString("]\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// sqlNamedArgs binds values of placeholders by their names.
+func sqlNamedArgs(values map[string]interface{}) []interface{} {
+	args := make([]interface{}, 0, len(values))
+	for name, value := range values {
+		args = append(args, sql.Named(name, value))
+	}
+
+	return args
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLParams(t *testing.T) {
+	tests := []struct {
+		query  string
+		params []string
+	}{
+		{"select 1", []string{}},
+		{"select * from notes where id=:id", []string{"id"}},
+		{"select :b, :a, :b", []string{"b", "a"}},
+		{"select :user_id+1", []string{"user_id"}},
+		{"select created_at::date from t where id=:id", []string{"id"}},
+		{"select :from::timestamp, :to::timestamp", []string{"from", "to"}},
+		{"select x::int[] from t", []string{}},
+		{"select ':skipped', \":skipped\" where a=:a", []string{"a"}},
+		{"select 'it''s :skipped' where a=:a", []string{"a"}},
+		{"select 1 -- :skipped\nwhere a=:a", []string{"a"}},
+		{"select /* :skipped */ :a /* :skipped", []string{"a"}},
+		{"select :1, : a, a:", []string{}},
+		{"select ':skipped", []string{}},
+	}
+
+	for _, test := range tests {
+		if params := SQLParams(test.query); !reflect.DeepEqual(params, test.params) {
+			t.Errorf("SQLParams(%q) = %q, want %q", test.query, params, test.params)
+		}
+	}
+}
+
+func TestParamValue(t *testing.T) {
+	tests := []struct {
+		value string
+		want  interface{}
+	}{
+		{"42", int64(42)},
+		{"-7", int64(-7)},
+		{"1.5", 1.5},
+		{"NULL", nil},
+		{"42a", "42a"},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if value := ParamValue(test.value); !reflect.DeepEqual(value, test.want) {
+			t.Errorf("ParamValue(%q) = %#v, want %#v", test.value, value, test.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Snippets mark matched words with these bytes, the client decides how to
+// show them.
+const (
+	HighlightStart = "\x02"
+	HighlightEnd   = "\x03"
+)
+
+// the index reads the queries from the blob store through a view, a blob
+// is never changed so the text removed from the index is the text added
+var ftsSchema = `CREATE VIEW IF NOT EXISTS "notes_text" AS
+	SELECT n.id, n.title, ` + noteBody("n.") + ` AS data_text FROM notes n;
+
+CREATE VIRTUAL TABLE IF NOT EXISTS "notes_fts" USING fts5(
+	title, data_text, content='notes_text', content_rowid='id'
+);
+
+CREATE TRIGGER IF NOT EXISTS "notes_fts_insert" AFTER INSERT ON "notes" BEGIN
+	INSERT INTO notes_fts(rowid, title, data_text) VALUES (new.id, new.title, ` + noteBody("new.") + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS "notes_fts_delete" AFTER DELETE ON "notes" BEGIN
+	INSERT INTO notes_fts(notes_fts, rowid, title, data_text) VALUES ('delete', old.id, old.title, ` + noteBody("old.") + `);
+END;
+
+CREATE TRIGGER IF NOT EXISTS "notes_fts_update" AFTER UPDATE OF title, data_text, body_blob ON "notes" BEGIN
+	INSERT INTO notes_fts(notes_fts, rowid, title, data_text) VALUES ('delete', old.id, old.title, ` + noteBody("old.") + `);
+	INSERT INTO notes_fts(rowid, title, data_text) VALUES (new.id, new.title, ` + noteBody("new.") + `);
+END;`
+
+// the triggers can't run without FTS5 so a binary built without it drops
+// them, the index is rebuilt on the next start with FTS5
+const ftsDropTriggers = `DROP TRIGGER IF EXISTS "notes_fts_insert";
+DROP TRIGGER IF EXISTS "notes_fts_delete";
+DROP TRIGGER IF EXISTS "notes_fts_update";`
+
+type SearchResult struct {
+	Note
+	Snippet string  `db:"snippet" json:"snippet"`
+	Rank    float64 `db:"rank" json:"rank"`
+}
+
+// SetupFullTextSearch creates the full text index of notes and rebuilds it
+// from the notes table.
+func SetupFullTextSearch(db *sqlx.DB) error {
+	// an index of encrypted notes would keep their text in plain
+	if EncryptedAtRest() {
+		_, err := db.Exec(ftsDropTriggers + `DROP TABLE IF EXISTS "notes_fts";`)
+		return err
+	}
+
+	if !FullTextSearch {
+		_, err := db.Exec(ftsDropTriggers)
+		return err
+	}
+
+	// an index of notes_text replaces the one of notes before it
+	var views int
+	err := db.Get(&views, `select count(*) from sqlite_master where name='notes_fts' and sql like '%notes_text%'`)
+	if err != nil {
+		return err
+	}
+
+	if views == 0 {
+		if _, err = db.Exec(ftsDropTriggers + `DROP TABLE IF EXISTS "notes_fts";`); err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.Exec(ftsSchema); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO notes_fts(notes_fts) VALUES ('rebuild')")
+	return err
+}
+
+// SearchNotes finds notes by their titles and contents. With FTS5 query
+// is an FTS5 query supporting phrases, prefixes and boolean operators,
+// otherwise notes containing all words of query are returned.
+func (user *User) SearchNotes(db *sqlx.DB, query string, limit int) ([]SearchResult, error) {
+	if strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("search query is empty")
+	}
+
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+
+	if !FullTextSearch || EncryptedAtRest() {
+		return user.searchNotesLike(db, query, limit)
+	}
+
+	where, args := user.Scope().Where("n.")
+
+	results := make([]SearchResult, 0)
+	err := db.Select(&results, `select n.*,
+		snippet(notes_fts, -1, ?, ?, '...', 12) as snippet,
+		bm25(notes_fts, 10.0, 1.0) as rank
+		from notes_fts join notes n on n.id=notes_fts.rowid
+		where notes_fts match ? and `+where+` and n.deleted_at is null
+		order by rank limit ?`, append(append([]interface{}{HighlightStart, HighlightEnd, query}, args...), limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("wrong search query: %s", err)
+	}
+
+	if err = user.loadSearchDetails(db, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (user *User) searchNotesLike(db *sqlx.DB, query string, limit int) ([]SearchResult, error) {
+	words := SearchWords(query)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("search query has no words")
+	}
+
+	// encrypted notes are searched after decryption
+	if EncryptedAtRest() {
+		notes, err := user.GetNotesByUser(db)
+		if err != nil {
+			return nil, err
+		}
+
+		return MatchWords(notes, words, limit), nil
+	}
+
+	scope, args := user.Scope().Where("")
+	where := []string{scope}
+	for _, word := range words {
+		where = append(where, "(lower(title) like ? or lower("+noteBody("")+") like ?)")
+		args = append(args, "%"+word+"%", "%"+word+"%")
+	}
+
+	notes := make([]Note, 0)
+	err := db.Select(&notes, "select * from notes where deleted_at is null and "+
+		strings.Join(where, " and "), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	results := MatchWords(notes, words, limit)
+	if err = user.loadSearchDetails(db, results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// SearchWords drops FTS5 syntax from query, what is left is matched as
+// plain lower case words.
+func SearchWords(query string) []string {
+	words := make([]string, 0)
+	for _, word := range strings.Fields(query) {
+		if word == "AND" || word == "OR" || word == "NOT" {
+			continue
+		}
+
+		if word = strings.Trim(word, "\"*()^"); word != "" {
+			words = append(words, strings.ToLower(word))
+		}
+	}
+
+	return words
+}
+
+// MatchWords returns notes containing all of words ranked by how often
+// they occur, matches in titles count more.
+func MatchWords(notes []Note, words []string, limit int) []SearchResult {
+	results := make([]SearchResult, 0, len(notes))
+	for _, note := range notes {
+		result := SearchResult{Note: note}
+		title, data := strings.ToLower(note.Title), strings.ToLower(note.Data)
+
+		for _, word := range words {
+			count := strings.Count(title, word)*10 + strings.Count(data, word)
+			if count == 0 {
+				result.Rank = 0
+				break
+			}
+			result.Rank -= float64(count)
+		}
+
+		if result.Rank == 0 {
+			continue
+		}
+
+		result.Snippet = likeSnippet(note.Data, words)
+		results = append(results, result)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Rank < results[j].Rank })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results
+}
+
+func (user *User) loadSearchDetails(db *sqlx.DB, results []SearchResult) error {
+	notes := make([]Note, len(results))
+	for i := range results {
+		notes[i] = results[i].Note
+	}
+
+	if err := user.LoadNoteDetails(db, notes); err != nil {
+		return err
+	}
+
+	for i := range results {
+		results[i].Note = notes[i]
+	}
+
+	return nil
+}
+
+// likeSnippet cuts the part of text around the first of words and
+// highlights every occurrence of words in it.
+func likeSnippet(text string, words []string) string {
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		lower = text
+	}
+
+	start := 0
+	for _, word := range words {
+		if i := strings.Index(lower, word); i >= 0 {
+			start = i
+			break
+		}
+	}
+
+	from, to := start-40, start+80
+	if from < 0 {
+		from = 0
+	}
+	if to > len(text) {
+		to = len(text)
+	}
+
+	// don't cut multibyte characters in half
+	for from > 0 && !isRuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !isRuneStart(text[to]) {
+		to++
+	}
+
+	part, lower_part := text[from:to], lower[from:to]
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("...")
+	}
+
+	for i := 0; i < len(part); {
+		matched := ""
+		for _, word := range words {
+			if strings.HasPrefix(lower_part[i:], word) && len(word) > len(matched) {
+				matched = word
+			}
+		}
+
+		if matched == "" {
+			b.WriteByte(part[i])
+			i++
+			continue
+		}
+
+		b.WriteString(HighlightStart + part[i:i+len(matched)] + HighlightEnd)
+		i += len(matched)
+	}
+
+	if to < len(text) {
+		b.WriteString("...")
+	}
+
+	return b.String()
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
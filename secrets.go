@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wordlist has one word per line, 1441 words give about 10.5 bits of
+// entropy per word of a passphrase.
+//
+//go:embed wordlist.txt
+var wordlist string
+
+var passwordCharsets = map[string]string{
+	"lower":   "abcdefghijklmnopqrstuvwxyz",
+	"upper":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"digits":  "0123456789",
+	"symbols": "!#$%&*+-=?@^_~.,:;",
+}
+
+var DefaultCharsets = []string{"lower", "upper", "digits", "symbols"}
+
+func randomIndex(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(i.Int64()), nil
+}
+
+// GeneratePassword returns a random password of length characters from
+// the named charsets with at least one character of each of them.
+func GeneratePassword(length int, charsets []string) (string, error) {
+	if len(charsets) == 0 {
+		charsets = DefaultCharsets
+	}
+
+	if length < len(charsets) || length > 1024 {
+		return "", fmt.Errorf("password length must be from %d to 1024", len(charsets))
+	}
+
+	all := ""
+	password := make([]byte, 0, length)
+	for _, name := range charsets {
+		chars, ok := passwordCharsets[strings.TrimSpace(name)]
+		if !ok {
+			return "", fmt.Errorf("unknown charset \"%s\", use lower, upper, digits or symbols", name)
+		}
+		all += chars
+
+		i, err := randomIndex(len(chars))
+		if err != nil {
+			return "", err
+		}
+		password = append(password, chars[i])
+	}
+
+	for len(password) < length {
+		i, err := randomIndex(len(all))
+		if err != nil {
+			return "", err
+		}
+		password = append(password, all[i])
+	}
+
+	// the characters taken from every charset must not stay in front
+	for i := len(password) - 1; i > 0; i-- {
+		j, err := randomIndex(i + 1)
+		if err != nil {
+			return "", err
+		}
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password), nil
+}
+
+// GeneratePassphrase returns words random words of the embedded word list
+// joined by separator.
+func GeneratePassphrase(words int, separator string) (string, error) {
+	if words < 1 || words > 64 {
+		return "", fmt.Errorf("number of words must be from 1 to 64")
+	}
+
+	list := strings.Fields(wordlist)
+	chosen := make([]string, 0, words)
+	for len(chosen) < words {
+		i, err := randomIndex(len(list))
+		if err != nil {
+			return "", err
+		}
+		chosen = append(chosen, list[i])
+	}
+
+	return strings.Join(chosen, separator), nil
+}
+
+// TOTP is a time-based one-time password generator (RFC 6238) as described
+// by an otpauth:// URI.
+type TOTP struct {
+	Label     string
+	Secret    []byte
+	Digits    int
+	Period    int
+	Algorithm string
+}
+
+// FindOTPAuth returns the TOTP of the first otpauth://totp/ URI in text.
+func FindOTPAuth(text string) (*TOTP, error) {
+	i := strings.Index(text, "otpauth://")
+	if i < 0 {
+		return nil, fmt.Errorf("note has no otpauth:// URI")
+	}
+
+	uri := text[i:]
+	if j := strings.IndexAny(uri, " \t\r\n"); j >= 0 {
+		uri = uri[:j]
+	}
+
+	return ParseOTPAuth(uri)
+}
+
+func ParseOTPAuth(uri string) (*TOTP, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "otpauth" || u.Host != "totp" {
+		return nil, fmt.Errorf("only otpauth://totp/ URIs are supported")
+	}
+
+	query := u.Query()
+	secret := strings.ToUpper(strings.ReplaceAll(query.Get("secret"), " ", ""))
+	if secret == "" {
+		return nil, fmt.Errorf("otpauth URI has no secret")
+	}
+
+	totp := &TOTP{Label: strings.TrimPrefix(u.Path, "/"), Digits: 6, Period: 30, Algorithm: "SHA1"}
+
+	totp.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("wrong otpauth secret: %s", err)
+	}
+
+	if digits := query.Get("digits"); digits != "" {
+		if totp.Digits, err = strconv.Atoi(digits); err != nil || totp.Digits < 6 || totp.Digits > 10 {
+			return nil, fmt.Errorf("wrong otpauth digits \"%s\"", digits)
+		}
+	}
+
+	if period := query.Get("period"); period != "" {
+		if totp.Period, err = strconv.Atoi(period); err != nil || totp.Period < 1 {
+			return nil, fmt.Errorf("wrong otpauth period \"%s\"", period)
+		}
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		totp.Algorithm = strings.ToUpper(algorithm)
+	}
+
+	if totp.hash() == nil {
+		return nil, fmt.Errorf("unknown otpauth algorithm \"%s\"", totp.Algorithm)
+	}
+
+	return totp, nil
+}
+
+func (totp *TOTP) hash() func() hash.Hash {
+	switch totp.Algorithm {
+	case "SHA1":
+		return sha1.New
+	case "SHA256":
+		return sha256.New
+	case "SHA512":
+		return sha512.New
+	}
+
+	return nil
+}
+
+// Code returns the code valid at t and how long it stays valid.
+func (totp *TOTP) Code(t time.Time) (string, time.Duration) {
+	counter := uint64(t.Unix()) / uint64(totp.Period)
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(totp.hash(), totp.Secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := uint64(binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff)
+
+	modulo := uint64(1)
+	for i := 0; i < totp.Digits; i++ {
+		modulo *= 10
+	}
+
+	left := time.Duration(int64(totp.Period)-t.Unix()%int64(totp.Period)) * time.Second
+	return fmt.Sprintf("%0*d", totp.Digits, value%modulo), left
+}
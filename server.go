@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
@@ -27,6 +32,54 @@ const (
 	GetLikeTitleNotesT = 9
 	LogoutT            = 10
 	GetCountAllMyNotes = 11
+	TrashNotesT        = 12
+	RestoreNoteT       = 13
+	PurgeNoteT         = 14
+	TagNoteT           = 15
+	UntagNoteT         = 16
+	GetTagsT           = 17
+	GetNotesByTagsT    = 18
+	NotebookCreateT    = 19
+	NotebookRenameT    = 20
+	NotebookMoveT      = 21
+	NotebookDeleteT    = 22
+	NotebookListT      = 23
+	MoveNoteT          = 24
+	SearchT            = 25
+	FindT              = 26
+	ConflictT          = 27
+	ShareT             = 28
+	RevokeShareT       = 29
+	GetSharesT         = 30
+	GetSharedWithMeT   = 31
+	WorkspaceCreateT   = 32
+	WorkspaceMemberT   = 33
+	WorkspaceRemoveT   = 34
+	WorkspacesT        = 35
+	WorkspaceMembersT  = 36
+	WorkspaceSwitchT   = 37
+	KeyCheckT          = 38
+	SetKeyCheckT       = 39
+	LinksT             = 40
+	BacklinksT         = 41
+	AttachStartT       = 42
+	AttachChunkT       = 43
+	AttachFinishT      = 44
+	AttachmentsT       = 45
+	DetachT            = 46
+	DownloadT          = 47
+	UsageT             = 48
+	FlagNoteT          = 49
+	RemindT            = 50
+	UnremindT          = 51
+	UpcomingT          = 52
+	NotifyT            = 53
+	ItemAddT           = 54
+	ItemCheckT         = 55
+	ItemMoveT          = 56
+	ItemRemoveT        = 57
+	BulkT              = 58
+	ExportT            = 59
 )
 
 type MessageData struct {
@@ -38,168 +91,902 @@ type ErrorMessageData struct {
 	ErrorText string `json:"error_text"`
 }
 
+// ConflictData is sent instead of an error when a note was changed since
+// the version given by the client, Note is the current one.
+type ConflictData struct {
+	ErrorText string `json:"error_text"`
+	Note      Note   `json:"note"`
+}
+
 type NoteSliceData struct {
 	Count int
 	Notes []Note
 }
 
-func ClientMsgWorker(connection net.Conn, db *sqlx.DB, user *User) (bool, error) {
-	msg := new(MessageData)
-	note := new(Note)
+type TagData struct {
+	NoteId int      `json:"note_id"`
+	Tags   []string `json:"tags"`
+}
+
+// NoteFlagData sets Flag, pinned or favorite, of the note with NoteId.
+type NoteFlagData struct {
+	NoteId int    `json:"note_id"`
+	Flag   string `json:"flag"`
+	Value  bool   `json:"value"`
+}
+
+type TagSliceData struct {
+	Tags []TagCount `json:"tags"`
+}
+
+// NotebookData is the payload of notebook messages, Name is the new name
+// for renaming and Parent is the path of the new parent for moving.
+type NotebookData struct {
+	Path   string `json:"path"`
+	Name   string `json:"name,omitempty"`
+	Parent string `json:"parent,omitempty"`
+	NoteId int    `json:"note_id,omitempty"`
+}
+
+type NotebookListData struct {
+	Path      string   `json:"path"`
+	Notebooks []string `json:"notebooks"`
+	Notes     []Note   `json:"notes"`
+}
+
+// ShareData shares the note with NoteId or, when it is 0, the notebook at
+// Notebook with UserName. Id is the share to revoke.
+type ShareData struct {
+	Id         int    `json:"id,omitempty"`
+	NoteId     int    `json:"note_id,omitempty"`
+	Notebook   string `json:"notebook,omitempty"`
+	UserName   string `json:"user_name,omitempty"`
+	Permission string `json:"permission,omitempty"`
+}
+
+type ShareSliceData struct {
+	Shares []Share `json:"shares"`
+}
+
+type SharedNoteSliceData struct {
+	Notes []SharedNote `json:"notes"`
+}
+
+// WorkspaceData is the payload of workspace messages, UserName and Role
+// are the member being added, changed or removed.
+type WorkspaceData struct {
+	Name     string `json:"name"`
+	UserName string `json:"user_name,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+type WorkspaceSliceData struct {
+	Workspaces []Workspace `json:"workspaces"`
+}
+
+type WorkspaceMemberSliceData struct {
+	Members []WorkspaceMember `json:"members"`
+}
+
+type NoteLinkSliceData struct {
+	Links []NoteLink `json:"links"`
+}
+
+// ChunkData carries chunk Seq of the attachment with AttachmentId, Data is
+// empty in requests for a chunk. The first chunk sent to the client comes
+// with the Attachment it belongs to.
+type ChunkData struct {
+	AttachmentId int         `json:"attachment_id"`
+	Seq          int         `json:"seq"`
+	Data         []byte      `json:"data,omitempty"`
+	Attachment   *Attachment `json:"attachment,omitempty"`
+}
+
+// ChecklistItemSliceData are the items of a checklist after an item
+// operation.
+type ChecklistItemSliceData struct {
+	Items []ChecklistItem `json:"items"`
+}
+
+type BulkData struct {
+	Ops []BulkOp `json:"ops"`
+}
+
+// BulkResultData has a result for every operation of a bulk request,
+// Committed is false when any of them failed and nothing was changed.
+type BulkResultData struct {
+	Results   []BulkResult `json:"results"`
+	Committed bool         `json:"committed"`
+}
+
+// ExportData asks for the page of an export after the note with id After,
+// the answer has its Notes and the id to ask for next in Next, which is 0
+// after the last page.
+type ExportData struct {
+	After int    `json:"after"`
+	Notes []Note `json:"notes,omitempty"`
+	Next  int    `json:"next,omitempty"`
+}
+
+type ReminderSliceData struct {
+	Reminders []Reminder `json:"reminders"`
+}
+
+type AttachmentSliceData struct {
+	Attachments []Attachment `json:"attachments"`
+}
+
+type SearchData struct {
+	Query string `json:"query"`
+	Limit int    `json:"limit"`
+	ListOptions
+}
+
+type SearchResultData struct {
+	Results []SearchResult `json:"results"`
+}
+
+type TagFilterData struct {
+	Tags     []string `json:"tags"`
+	MatchAll bool     `json:"match_all"`
+	Title    string   `json:"title"`
+	ListOptions
+}
+
+type TitleFilterData struct {
+	Title string `json:"title"`
+	ListOptions
+}
+
+func ClientMsgWorker(connection net.Conn, db *sqlx.DB, user *User) (bool, error) {
+	for {
+		// fresh values for every message, unmarshaling into the previous
+		// ones would keep the fields the client omitted
+		msg := new(MessageData)
+		note := new(Note)
+
+		bytes, err := GetMessageData(connection)
+		if err != nil {
+			return true, err
+		}
+
+		if err = json.Unmarshal(bytes, &msg); err != nil {
+			return true, err
+		}
+
+		// switching needs no membership of the workspace being left
+		if msg.MessageTypeStatus != WorkspaceSwitchT {
+			if err = user.CheckWorkspace(db); err != nil {
+				return false, err
+			}
+		}
+
+		switch msg.MessageTypeStatus {
+		case NewNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			if err = CheckNoteSize(note); err != nil {
+				return false, err
+			}
+
+			if err = note.CreateNote(db, user); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note has been created\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case GetNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			note, err = user.GetNoteById(db, note.Id)
+			if err != nil {
+				return false, err
+			}
+
+			note_data, err := json.Marshal(note)
+			if err != nil {
+				return true, err
+			}
+
+			msg.MessageTypeStatus = SuccessT
+			msg.Data = note_data
+
+			msg_data, err := json.Marshal(msg)
+			if err != nil {
+				return true, err
+			}
+
+			_, err = connection.Write(msg_data)
+			if err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) note has been sent\n", connection.RemoteAddr().String())
+		case UpdateNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			if err = CheckNoteSize(note); err != nil {
+				return false, err
+			}
+
+			if err = user.EditNoteById(db, *note); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note has been updated\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case DeleteNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			if err = user.DeleteNoteById(db, *note); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note has been deleted\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case GetAllMyNotesT:
+			note_slice := NoteSliceData{}
+
+			opts := ListOptions{}
+			if len(msg.Data) > 0 {
+				if err = json.Unmarshal(msg.Data, &opts); err != nil {
+					return true, err
+				}
+			}
+
+			notes, err := user.ListNotes(db, opts)
+			if err != nil {
+				return false, err
+			}
+
+			note_slice.Notes = notes
+			note_slice.Count, err = user.GetNotesNumberByUser(db)
+			if err != nil {
+				return false, err
+			}
+
+			note_slice_data, err := json.Marshal(note_slice)
+			if err != nil {
+				return true, err
+			}
+
+			msg.MessageTypeStatus = SuccessT
+			msg.Data = note_slice_data
+
+			msg_data, err := json.Marshal(msg)
+			if err != nil {
+				return true, err
+			}
+
+			if _, err = connection.Write(msg_data); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
+		case GetLikeTitleNotesT:
+			note_slice := NoteSliceData{}
+
+			filter := TitleFilterData{}
+			if err = json.Unmarshal(msg.Data, &filter); err != nil {
+				return true, err
+			}
+
+			if err = filter.Check(); err != nil {
+				return false, err
+			}
+
+			note_slice.Notes, err = user.GetNotesByTitle(db, filter.Title)
+			if err != nil {
+				return false, err
+			}
+
+			// titles encrypted at rest are matched after decryption, so
+			// the notes found are counted
+			note_slice.Count = len(note_slice.Notes)
+
+			SortNotes(note_slice.Notes, filter.ListOptions)
+			filter.ProjectNotes(note_slice.Notes)
+
+			note_slice_data, err := json.Marshal(note_slice)
+			if err != nil {
+				return true, err
+			}
+
+			msg.MessageTypeStatus = SuccessT
+			msg.Data = note_slice_data
+
+			msg_data, err := json.Marshal(msg)
+			if err != nil {
+				return true, err
+			}
+
+			_, err = connection.Write(msg_data)
+			if err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
+		case TrashNotesT:
+			notes, err := user.GetTrashNotes(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, NoteSliceData{Count: len(notes), Notes: notes}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) trash has been sent\n", connection.RemoteAddr().String())
+		case RestoreNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			if err = user.RestoreNoteById(db, note.Id); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note has been restored\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case PurgeNoteT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			if err = user.PurgeNoteById(db, note.Id); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note has been purged\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case TagNoteT, UntagNoteT:
+			tag_data := TagData{}
+			if err = json.Unmarshal(msg.Data, &tag_data); err != nil {
+				return true, err
+			}
+
+			if msg.MessageTypeStatus == TagNoteT {
+				err = user.TagNoteById(db, tag_data.NoteId, tag_data.Tags)
+			} else {
+				err = user.UntagNoteById(db, tag_data.NoteId, tag_data.Tags)
+			}
+			if err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) note tags have been changed\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case GetTagsT:
+			tags, err := user.GetTags(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, TagSliceData{Tags: tags}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) tags have been sent\n", connection.RemoteAddr().String())
+		case GetNotesByTagsT:
+			filter := TagFilterData{}
+			if err = json.Unmarshal(msg.Data, &filter); err != nil {
+				return true, err
+			}
+
+			if err = filter.Check(); err != nil {
+				return false, err
+			}
+
+			notes, err := user.GetNotesByTags(db, filter.Tags, filter.MatchAll, filter.Title)
+			if err != nil {
+				return false, err
+			}
+
+			SortNotes(notes, filter.ListOptions)
+			filter.ProjectNotes(notes)
+
+			if err = SendData(connection, NoteSliceData{Count: len(notes), Notes: notes}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
+		case NotebookCreateT, NotebookRenameT, NotebookMoveT, NotebookDeleteT, MoveNoteT:
+			notebook_data := NotebookData{}
+			if err = json.Unmarshal(msg.Data, &notebook_data); err != nil {
+				return true, err
+			}
+
+			switch msg.MessageTypeStatus {
+			case NotebookCreateT:
+				err = user.CreateNotebook(db, notebook_data.Path)
+			case NotebookRenameT:
+				err = user.RenameNotebook(db, notebook_data.Path, notebook_data.Name)
+			case NotebookMoveT:
+				err = user.MoveNotebook(db, notebook_data.Path, notebook_data.Parent)
+			case NotebookDeleteT:
+				err = user.DeleteNotebook(db, notebook_data.Path)
+			case MoveNoteT:
+				err = user.MoveNoteById(db, notebook_data.NoteId, notebook_data.Path)
+			}
+			if err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) notebooks have been changed\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case NotebookListT:
+			notebook_data := NotebookData{}
+			if err = json.Unmarshal(msg.Data, &notebook_data); err != nil {
+				return true, err
+			}
+
+			notebooks, notes, err := user.ListNotebook(db, notebook_data.Path)
+			if err != nil {
+				return false, err
+			}
+
+			list := NotebookListData{Path: notebook_data.Path, Notebooks: notebooks, Notes: notes}
+			if err = SendData(connection, list); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) notebook has been sent\n", connection.RemoteAddr().String())
+		case SearchT:
+			search := SearchData{}
+			if err = json.Unmarshal(msg.Data, &search); err != nil {
+				return true, err
+			}
+
+			if err = search.Check(); err != nil {
+				return false, err
+			}
+
+			results, err := user.SearchNotes(db, search.Query, search.Limit)
+			if err != nil {
+				return false, err
+			}
+
+			SortSearchResults(results, search.ListOptions)
+			for i := range results {
+				search.ProjectNote(&results[i].Note)
+			}
+
+			if err = SendData(connection, SearchResultData{Results: results}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) search results have been sent\n", connection.RemoteAddr().String())
+		case FindT:
+			search := SearchData{}
+			if err = json.Unmarshal(msg.Data, &search); err != nil {
+				return true, err
+			}
+
+			if err = search.Check(); err != nil {
+				return false, err
+			}
+
+			notes, err := user.FindNotes(db, search.Query)
+			if err != nil {
+				return false, err
+			}
+
+			SortNotes(notes, search.ListOptions)
+			search.ProjectNotes(notes)
+
+			if err = SendData(connection, NoteSliceData{Count: len(notes), Notes: notes}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
+		case ShareT, RevokeShareT:
+			share := ShareData{}
+			if err = json.Unmarshal(msg.Data, &share); err != nil {
+				return true, err
+			}
+
+			if msg.MessageTypeStatus == ShareT {
+				err = user.Share(db, share.NoteId, share.Notebook, share.UserName, share.Permission)
+			} else {
+				err = user.RevokeShare(db, share.Id)
+			}
+			if err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) shares have been changed\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case GetSharesT:
+			shares, err := user.GetShares(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, ShareSliceData{Shares: shares}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) shares have been sent\n", connection.RemoteAddr().String())
+		case GetSharedWithMeT:
+			notes, err := user.GetSharedWithMe(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, SharedNoteSliceData{Notes: notes}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) shared notes have been sent\n", connection.RemoteAddr().String())
+		case WorkspaceCreateT, WorkspaceMemberT, WorkspaceRemoveT:
+			workspace := WorkspaceData{}
+			if err = json.Unmarshal(msg.Data, &workspace); err != nil {
+				return true, err
+			}
+
+			switch msg.MessageTypeStatus {
+			case WorkspaceCreateT:
+				err = user.CreateWorkspace(db, workspace.Name)
+			case WorkspaceMemberT:
+				err = user.SetWorkspaceMember(db, workspace.Name, workspace.UserName, workspace.Role)
+			case WorkspaceRemoveT:
+				err = user.RemoveWorkspaceMember(db, workspace.Name, workspace.UserName)
+			}
+			if err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) workspaces have been changed\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case WorkspacesT:
+			workspaces, err := user.GetWorkspaces(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, WorkspaceSliceData{Workspaces: workspaces}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) workspaces have been sent\n", connection.RemoteAddr().String())
+		case WorkspaceMembersT:
+			workspace := WorkspaceData{}
+			if err = json.Unmarshal(msg.Data, &workspace); err != nil {
+				return true, err
+			}
+
+			members, err := user.GetWorkspaceMembers(db, workspace.Name)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, WorkspaceMemberSliceData{Members: members}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) workspace members have been sent\n", connection.RemoteAddr().String())
+		case WorkspaceSwitchT:
+			workspace := WorkspaceData{}
+			if err = json.Unmarshal(msg.Data, &workspace); err != nil {
+				return true, err
+			}
+
+			if err = user.SwitchWorkspace(db, workspace.Name); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) switched to workspace \"%s\"\n", connection.RemoteAddr().String(), workspace.Name)
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case KeyCheckT:
+			key, err := user.GetKeyCheck(db)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, key); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) key check has been sent\n", connection.RemoteAddr().String())
+		case SetKeyCheckT:
+			key := KeyCheck{}
+			if err = json.Unmarshal(msg.Data, &key); err != nil {
+				return true, err
+			}
+
+			if err = user.SetKeyCheck(db, key); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) turned on encryption\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case LinksT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			links, err := user.GetNoteLinks(db, note.Id)
+			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, NoteLinkSliceData{Links: links}); err != nil {
+				return true, err
+			}
 
-	for {
-		bytes, err := GetMessageData(connection)
-		if err != nil {
-			return true, err
-		}
+			log.Printf("client(%s) links have been sent\n", connection.RemoteAddr().String())
+		case BacklinksT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
 
-		if err = json.Unmarshal(bytes, &msg); err != nil {
-			return true, err
-		}
+			notes, err := user.GetBacklinks(db, note.Id)
+			if err != nil {
+				return false, err
+			}
 
-		switch msg.MessageTypeStatus {
-		case NewNoteT:
-			if err = json.Unmarshal(msg.Data, &note); err != nil {
+			if err = SendData(connection, NoteSliceData{Count: len(notes), Notes: notes}); err != nil {
 				return true, err
 			}
 
-			if err = note.CreateNote(db, user); err != nil {
+			log.Printf("client(%s) backlinks have been sent\n", connection.RemoteAddr().String())
+		case FlagNoteT:
+			flag := NoteFlagData{}
+			if err = json.Unmarshal(msg.Data, &flag); err != nil {
+				return true, err
+			}
+
+			if err = user.SetNoteFlag(db, flag.NoteId, flag.Flag, flag.Value); err != nil {
 				return false, err
 			}
 
-			log.Printf("client(%s) note has been created\n", connection.RemoteAddr().String())
+			log.Printf("client(%s) note has been flagged\n", connection.RemoteAddr().String())
 			if err = SendStatus(connection, SuccessT); err != nil {
 				return true, err
 			}
-		case GetNoteT:
-			if err = json.Unmarshal(msg.Data, &note); err != nil {
+		case ItemAddT, ItemCheckT, ItemMoveT, ItemRemoveT:
+			item := ChecklistItem{}
+			if err = json.Unmarshal(msg.Data, &item); err != nil {
 				return true, err
 			}
 
-			note, err = user.GetNoteById(db, note.Id)
+			var note_id int
+			switch msg.MessageTypeStatus {
+			case ItemAddT:
+				note_id, err = user.AddChecklistItem(db, item.NoteId, item.Text)
+			case ItemCheckT:
+				note_id, err = user.CheckChecklistItem(db, item.Id, item.Checked)
+			case ItemMoveT:
+				note_id, err = user.MoveChecklistItem(db, item.Id, item.Position)
+			case ItemRemoveT:
+				note_id, err = user.RemoveChecklistItem(db, item.Id)
+			}
 			if err != nil {
 				return false, err
 			}
 
-			note_data, err := json.Marshal(note)
+			items, err := user.GetChecklistItems(db, note_id)
 			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, ChecklistItemSliceData{Items: items}); err != nil {
 				return true, err
 			}
 
-			msg.MessageTypeStatus = SuccessT
-			msg.Data = note_data
+			log.Printf("client(%s) checklist has been changed\n", connection.RemoteAddr().String())
+		case BulkT:
+			bulk := BulkData{}
+			if err = json.Unmarshal(msg.Data, &bulk); err != nil {
+				return true, err
+			}
 
-			msg_data, err := json.Marshal(msg)
+			results, committed, err := user.RunBulk(db, bulk.Ops)
 			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, BulkResultData{Results: results, Committed: committed}); err != nil {
 				return true, err
 			}
 
-			_, err = connection.Write(msg_data)
+			log.Printf("client(%s) bulk request of %d operations has been run\n", connection.RemoteAddr().String(), len(bulk.Ops))
+		case ExportT:
+			page := ExportData{}
+			if err = json.Unmarshal(msg.Data, &page); err != nil {
+				return true, err
+			}
+
+			notes, next, err := user.ExportNotes(db, page.After)
 			if err != nil {
+				return false, err
+			}
+
+			if err = SendData(connection, ExportData{After: page.After, Notes: notes, Next: next}); err != nil {
 				return true, err
 			}
 
-			log.Printf("client(%s) note has been sent\n", connection.RemoteAddr().String())
-		case UpdateNoteT:
-			if err = json.Unmarshal(msg.Data, &note); err != nil {
+			log.Printf("client(%s) export page of %d notes has been sent\n", connection.RemoteAddr().String(), len(notes))
+		case RemindT:
+			reminder := Reminder{}
+			if err = json.Unmarshal(msg.Data, &reminder); err != nil {
 				return true, err
 			}
 
-			if err = user.EditNoteById(db, *note); err != nil {
+			set, err := user.SetReminder(db, reminder)
+			if err != nil {
 				return false, err
 			}
 
-			log.Printf("client(%s) note has been updated\n", connection.RemoteAddr().String())
-			if err = SendStatus(connection, SuccessT); err != nil {
+			if err = SendData(connection, set); err != nil {
 				return true, err
 			}
-		case DeleteNoteT:
-			if err = json.Unmarshal(msg.Data, &note); err != nil {
+
+			log.Printf("client(%s) reminder has been set\n", connection.RemoteAddr().String())
+		case UnremindT:
+			reminder := Reminder{}
+			if err = json.Unmarshal(msg.Data, &reminder); err != nil {
 				return true, err
 			}
 
-			if err = user.DeleteNoteById(db, *note); err != nil {
+			if err = user.DeleteReminder(db, reminder.NoteId); err != nil {
 				return false, err
 			}
 
-			log.Printf("client(%s) note has been deleted\n", connection.RemoteAddr().String())
+			log.Printf("client(%s) reminder has been deleted\n", connection.RemoteAddr().String())
 			if err = SendStatus(connection, SuccessT); err != nil {
 				return true, err
 			}
-		case GetAllMyNotesT:
-			note_slice := NoteSliceData{}
-
-			notes, err := user.GetNotesByUser(db)
+		case UpcomingT:
+			reminders, err := user.GetReminders(db)
 			if err != nil {
 				return false, err
 			}
 
-			note_slice.Notes = notes
-			note_slice.Count, err = user.GetNotesNumberByUser(db)
+			if err = SendData(connection, ReminderSliceData{Reminders: reminders}); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) reminders have been sent\n", connection.RemoteAddr().String())
+		case UsageT:
+			usage, err := user.GetUsage(db)
 			if err != nil {
 				return false, err
 			}
 
-			note_slice_data, err := json.Marshal(note_slice)
-			if err != nil {
+			if err = SendData(connection, usage); err != nil {
 				return true, err
 			}
 
-			msg.MessageTypeStatus = SuccessT
-			msg.Data = note_slice_data
-
-			msg_data, err := json.Marshal(msg)
-			if err != nil {
+			log.Printf("client(%s) usage has been sent\n", connection.RemoteAddr().String())
+		case AttachStartT:
+			attachment := Attachment{}
+			if err = json.Unmarshal(msg.Data, &attachment); err != nil {
 				return true, err
 			}
 
-			if _, err = connection.Write(msg_data); err != nil {
+			if err = user.StartUpload(db, attachment); err != nil {
+				return false, err
+			}
+
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case AttachChunkT:
+			chunk := ChunkData{}
+			if err = json.Unmarshal(msg.Data, &chunk); err != nil {
 				return true, err
 			}
 
-			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
-		case GetLikeTitleNotesT:
-			note_slice := NoteSliceData{}
+			if err = user.AddChunk(chunk.Seq, chunk.Data); err != nil {
+				return false, err
+			}
 
-			if err = json.Unmarshal(msg.Data, &note); err != nil {
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case AttachFinishT:
+			attachment := &Attachment{}
+			if err = json.Unmarshal(msg.Data, attachment); err != nil {
 				return true, err
 			}
 
-			note_slice.Notes, err = user.GetNotesByTitle(db, note.Title)
+			attachment, err = user.FinishUpload(db, attachment.Sha256)
 			if err != nil {
 				return false, err
 			}
 
-			note_slice.Count, err = user.GetNotesNumberByTitle(db, note.Title)
+			if err = SendData(connection, attachment); err != nil {
+				return true, err
+			}
+
+			log.Printf("client(%s) attachment has been stored\n", connection.RemoteAddr().String())
+		case AttachmentsT:
+			if err = json.Unmarshal(msg.Data, &note); err != nil {
+				return true, err
+			}
+
+			attachments, err := user.GetAttachments(db, note.Id)
 			if err != nil {
 				return false, err
 			}
 
-			note_slice_data, err := json.Marshal(note_slice)
-			if err != nil {
+			if err = SendData(connection, AttachmentSliceData{Attachments: attachments}); err != nil {
 				return true, err
 			}
 
-			msg.MessageTypeStatus = SuccessT
-			msg.Data = note_slice_data
+			log.Printf("client(%s) attachments have been sent\n", connection.RemoteAddr().String())
+		case DetachT:
+			attachment := Attachment{}
+			if err = json.Unmarshal(msg.Data, &attachment); err != nil {
+				return true, err
+			}
 
-			msg_data, err := json.Marshal(msg)
-			if err != nil {
+			if err = user.DeleteAttachment(db, attachment.Id); err != nil {
+				return false, err
+			}
+
+			log.Printf("client(%s) attachment has been deleted\n", connection.RemoteAddr().String())
+			if err = SendStatus(connection, SuccessT); err != nil {
+				return true, err
+			}
+		case DownloadT:
+			chunk := ChunkData{}
+			if err = json.Unmarshal(msg.Data, &chunk); err != nil {
 				return true, err
 			}
 
-			_, err = connection.Write(msg_data)
+			attachment, data, err := user.GetAttachmentChunk(db, chunk.AttachmentId, chunk.Seq)
 			if err != nil {
-				return true, err
+				return false, err
 			}
 
-			log.Printf("client(%s) notes has been sent\n", connection.RemoteAddr().String())
+			chunk.Data = data
+			if chunk.Seq == 0 {
+				chunk.Attachment = attachment
+			}
+
+			if err = SendData(connection, chunk); err != nil {
+				return true, err
+			}
 		}
 
 	}
 }
 
-func ClientWorker(connection net.Conn, db *sqlx.DB, ch chan struct{}) {
+func ClientWorker(conn net.Conn, db *sqlx.DB, ch chan struct{}) {
+	connection := NewMessageConn(conn)
+	connection.SetReadLimit(MessageLimit())
 	defer func() {
 		connection.Close()
 		log.Printf("client(%s) disconnected\n", connection.RemoteAddr().String())
@@ -228,6 +1015,10 @@ func ClientWorker(connection net.Conn, db *sqlx.DB, ch chan struct{}) {
 			goto End
 		}
 
+		// the client reads the reply to the login before any notification
+		sessions.Add(user.Id, connection)
+		defer sessions.Remove(user.Id, connection)
+
 		for {
 			status, err := ClientMsgWorker(connection, db, user)
 			if status {
@@ -240,7 +1031,14 @@ func ClientWorker(connection net.Conn, db *sqlx.DB, ch chan struct{}) {
 				break
 			}
 			if err != nil {
-				if err = SendErrorMsg(connection, err.Error()); err != nil {
+				var conflict *ConflictError
+				if errors.As(err, &conflict) {
+					err = SendConflict(connection, conflict)
+				} else {
+					err = SendErrorMsg(connection, err.Error())
+				}
+
+				if err != nil {
 					log.Println(err)
 					break
 				}
@@ -321,6 +1119,23 @@ func SendErrorMsg(connection net.Conn, error_text string) error {
 	return err
 }
 
+func SendConflict(connection net.Conn, conflict *ConflictError) error {
+	conflict_data, err := json.Marshal(ConflictData{ErrorText: conflict.Error(), Note: conflict.Current})
+	if err != nil {
+		return err
+	}
+
+	msg := MessageData{MessageTypeStatus: ConflictT, Data: conflict_data}
+	msg_data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = connection.Write(msg_data)
+
+	return err
+}
+
 func SendStatus(connection net.Conn, status int) error {
 	msg := MessageData{MessageTypeStatus: status}
 	msg_data, err := json.Marshal(msg)
@@ -333,6 +1148,148 @@ func SendStatus(connection net.Conn, status int) error {
 	return err
 }
 
+// SendData sends a success message with data marshaled as its payload.
+func SendData(connection net.Conn, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	msg := MessageData{MessageTypeStatus: SuccessT, Data: payload}
+	msg_data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = connection.Write(msg_data)
+
+	return err
+}
+
+// StartTrashPurger periodically removes notes which have been in the trash
+// for longer than max_age, it is meant to be run in its own goroutine.
+func StartTrashPurger(db *sqlx.DB, max_age time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		n, err := PurgeTrash(db, max_age)
+		if err != nil {
+			log.Printf("trash purge: %s\n", err)
+		} else if n > 0 {
+			log.Printf("trash purge: %d notes removed\n", n)
+		}
+
+		<-ticker.C
+	}
+}
+
+// StartScheduler delivers due reminders to connected users every 30
+// seconds and when a user connects, it is meant to be run in its own
+// goroutine.
+func StartScheduler(db *sqlx.DB) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		n, err := DeliverReminders(db, time.Now())
+		if err != nil {
+			log.Printf("reminders: %s\n", err)
+		} else if n > 0 {
+			log.Printf("reminders: %d delivered\n", n)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sessions.wake:
+		}
+	}
+}
+
+// Sessions are the connections of authorized users, messages can be
+// pushed to them with Notify.
+type Sessions struct {
+	mu    sync.Mutex
+	conns map[int][]*MessageConn
+	wake  chan struct{}
+}
+
+var sessions = &Sessions{conns: make(map[int][]*MessageConn), wake: make(chan struct{}, 1)}
+
+// notifyTimeout is how long a pushed message may take to be written, a
+// client which doesn't read its messages must not hold up the sender.
+const notifyTimeout = 5 * time.Second
+
+// Add registers a connection of a user and wakes the scheduler, so
+// reminders which became due while the user was away are delivered.
+func (s *Sessions) Add(user_id int, conn *MessageConn) {
+	s.mu.Lock()
+	s.conns[user_id] = append(s.conns[user_id], conn)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Sessions) Remove(user_id int, conn *MessageConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conns := s.conns[user_id]
+	for i := range conns {
+		if conns[i] == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(s.conns, user_id)
+	} else {
+		s.conns[user_id] = conns
+	}
+}
+
+func (s *Sessions) Online(user_id int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns[user_id]) > 0
+}
+
+// Notify sends a message of Type with data to every connection of a user
+// and returns to how many it was sent. A connection which can't take the
+// message in notifyTimeout is closed, as a message written in part would
+// garble the ones after it.
+func (s *Sessions) Notify(user_id int, Type int, data interface{}) int {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return 0
+	}
+
+	msg_data, err := json.Marshal(MessageData{MessageTypeStatus: Type, Data: payload})
+	if err != nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	conns := append([]*MessageConn(nil), s.conns[user_id]...)
+	s.mu.Unlock()
+
+	sent := 0
+	for _, conn := range conns {
+		if _, err := conn.WriteTimeout(msg_data, notifyTimeout); err != nil {
+			conn.Close()
+			continue
+		}
+		sent++
+	}
+
+	return sent
+}
+
 func StartRoutineServer(host, port string, max_conn int, db *sqlx.DB) error {
 	if max_conn > 8 || max_conn < 1 {
 		return fmt.Errorf("max 8 / min 1")
@@ -361,12 +1318,157 @@ func StartRoutineServer(host, port string, max_conn int, db *sqlx.DB) error {
 	}
 }
 
-func GetMessageData(connection net.Conn) ([]byte, error) {
-	data := make([]byte, 8192)
-	n, err := connection.Read(data)
-	if err != nil {
+// MessageConn reads messages from a connection one JSON value at a time,
+// so a message may be larger than a single read and two messages read
+// together are not mixed up. Writes are serialized, as messages may be
+// pushed to a session while it answers a request.
+type MessageConn struct {
+	net.Conn
+	reader  *messageReader
+	decoder *json.Decoder
+	wmu     sync.Mutex
+
+	// responses and notifications are set by Dispatch
+	responses     chan []byte
+	notifications chan MessageData
+	err           error
+}
+
+func NewMessageConn(conn net.Conn) *MessageConn {
+	reader := &messageReader{r: conn}
+	return &MessageConn{Conn: conn, reader: reader, decoder: json.NewDecoder(reader)}
+}
+
+// ErrMessageTooLarge is returned for a message longer than the read limit
+// of a connection.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// messageReader counts what is read for the message being decoded, the
+// decoder may read ahead into the next one, so a message gets at most
+// twice the limit.
+type messageReader struct {
+	r           io.Reader
+	limit, left int64
+}
+
+func (r *messageReader) Read(p []byte) (int, error) {
+	if r.limit > 0 {
+		if r.left <= 0 {
+			return 0, ErrMessageTooLarge
+		}
+		if int64(len(p)) > r.left {
+			p = p[:r.left]
+		}
+	}
+
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
+
+// SetReadLimit limits every message read from now on to limit bytes, 0
+// means no limit. The server limits what clients send, answers of the
+// server are not limited.
+func (conn *MessageConn) SetReadLimit(limit int64) {
+	conn.reader.limit = limit
+}
+
+// decode reads the next message.
+func (conn *MessageConn) decode() (json.RawMessage, error) {
+	var data json.RawMessage
+
+	conn.reader.left = conn.reader.limit
+	if err := conn.decoder.Decode(&data); err != nil {
 		return nil, err
 	}
 
-	return data[:n], nil
+	return data, nil
+}
+
+// MessageLimit returns the largest message the server reads from a client:
+// an attachment chunk, which is base64 encoded in ChunkData and again in
+// MessageData, or a note of max_note_size with all of it escaped in JSON.
+func MessageLimit() int64 {
+	const envelope = 1024
+
+	limit := int64(base64.StdEncoding.EncodedLen(base64.StdEncoding.EncodedLen(AttachmentChunkSize)+envelope) + envelope)
+	if note := int64(base64.StdEncoding.EncodedLen(6*quotas.MaxNoteSize+envelope) + envelope); note > limit {
+		limit = note
+	}
+
+	return limit
+}
+
+func (conn *MessageConn) Write(b []byte) (int, error) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+
+	return conn.Conn.Write(b)
+}
+
+// WriteTimeout writes b like Write but gives up after timeout.
+func (conn *MessageConn) WriteTimeout(b []byte, timeout time.Duration) (int, error) {
+	conn.wmu.Lock()
+	defer conn.wmu.Unlock()
+
+	if err := conn.Conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	defer conn.Conn.SetWriteDeadline(time.Time{})
+
+	return conn.Conn.Write(b)
+}
+
+// Dispatch reads messages in the background from now on, notifications
+// pushed by the server go to Notifications and the rest are answers read
+// by GetMessageData.
+func (conn *MessageConn) Dispatch() {
+	conn.responses = make(chan []byte)
+	conn.notifications = make(chan MessageData, 64)
+
+	go func() {
+		defer close(conn.responses)
+		defer close(conn.notifications)
+
+		for {
+			data, err := conn.decode()
+			if err != nil {
+				conn.err = err
+				return
+			}
+
+			msg := MessageData{}
+			if json.Unmarshal(data, &msg) == nil && msg.MessageTypeStatus == NotifyT {
+				// a client which doesn't keep up misses notifications
+				select {
+				case conn.notifications <- msg:
+				default:
+				}
+				continue
+			}
+
+			conn.responses <- data
+		}
+	}()
+}
+
+func (conn *MessageConn) Notifications() <-chan MessageData {
+	return conn.notifications
+}
+
+func GetMessageData(connection net.Conn) ([]byte, error) {
+	conn, ok := connection.(*MessageConn)
+	if !ok {
+		conn = NewMessageConn(connection)
+	}
+
+	if conn.responses != nil {
+		data, ok := <-conn.responses
+		if !ok {
+			return nil, conn.err
+		}
+		return data, nil
+	}
+
+	return conn.decode()
 }
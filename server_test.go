@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMessageLimit(t *testing.T) {
+	chunk := func(size int) []byte {
+		payload, err := json.Marshal(ChunkData{AttachmentId: 1 << 30, Seq: 1 << 30, Data: make([]byte, size)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := json.Marshal(MessageData{MessageTypeStatus: AttachChunkT, Data: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		valid bool
+	}{
+		{"empty", []byte(`{}`), true},
+		{"whole chunk", chunk(AttachmentChunkSize), true},
+		{"whole chunk again", chunk(AttachmentChunkSize), true},
+		{"twice a chunk", chunk(2 * AttachmentChunkSize), false},
+		{"endless string", []byte(`{"Data":"` + strings.Repeat("A", int(2*MessageLimit())) + `"}`), false},
+	}
+
+	for _, test := range tests {
+		client, server := net.Pipe()
+		conn := NewMessageConn(server)
+		conn.SetReadLimit(MessageLimit())
+
+		go func() {
+			client.Write(test.msg)
+			client.Write(test.msg)
+			client.Close()
+		}()
+
+		for i := 0; i < 2; i++ {
+			data, err := GetMessageData(conn)
+			if test.valid && (err != nil || len(data) != len(test.msg)) {
+				t.Errorf("%s: message %d read %d of %d bytes: %v", test.name, i, len(data), len(test.msg), err)
+			}
+			if !test.valid && i == 0 && !errors.Is(err, ErrMessageTooLarge) {
+				t.Errorf("%s: error = %v, want %v", test.name, err, ErrMessageTooLarge)
+			}
+		}
+
+		server.Close()
+	}
+}
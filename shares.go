@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Share is a note or a notebook (with everything in it) shared by its
+// owner with another user.
+type Share struct {
+	Id         int
+	OwnerId    int    `db:"owner_id" json:"owner_id"`
+	UserId     int    `db:"user_id" json:"user_id"`
+	NoteId     *int   `db:"note_id" json:"note_id,omitempty"`
+	NotebookId *int   `db:"notebook_id" json:"notebook_id,omitempty"`
+	Permission string `db:"permission" json:"permission"`
+
+	UserName  string `db:"user_name" json:"user_name"`
+	NoteTitle string `db:"-" json:"note_title,omitempty"`
+	Notebook  string `db:"-" json:"notebook,omitempty"`
+}
+
+type SharedNote struct {
+	Note
+	Owner      string `db:"owner" json:"owner"`
+	Permission string `db:"-" json:"permission"`
+}
+
+// Share gives user_name perm on the note with note_id or, when note_id is
+// 0, on the notebook at path, which needs owner permission in the active
+// scope. Sharing the same thing again changes the permission.
+func (user *User) Share(db *sqlx.DB, note_id int, path, user_name, perm string) error {
+	permission, err := ParsePermission(perm)
+	if err != nil {
+		return err
+	}
+
+	recipient, err := GetUser(db, user_name)
+	if err != nil {
+		return fmt.Errorf("user \"%s\" not found", user_name)
+	}
+
+	if recipient.Id == user.Id {
+		return fmt.Errorf("you can't share with yourself")
+	}
+
+	share := Share{OwnerId: user.Id, UserId: recipient.Id, Permission: permission.String()}
+	if note_id != 0 {
+		note, err := user.GetNoteWithPermission(db, note_id, PermOwner)
+		if err != nil {
+			return err
+		}
+		share.NoteId = &note.Id
+	} else {
+		// a share of a notebook reaches every note in it, including the
+		// ones of other members of a workspace
+		if err = user.RequireScopePermission(db, PermOwner); err != nil {
+			return err
+		}
+
+		notebook, err := user.GetNotebookByPath(db, path)
+		if err != nil {
+			return err
+		}
+
+		if notebook == nil {
+			return fmt.Errorf("root notebook can't be shared")
+		}
+		share.NotebookId = notebook.IdPtr()
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	_, err = tx.NamedExec(`delete from shares where owner_id=:owner_id and user_id=:user_id
+		and note_id is :note_id and notebook_id is :notebook_id`, share)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExec(`insert into shares (owner_id, user_id, note_id, notebook_id, permission)
+		values (:owner_id, :user_id, :note_id, :notebook_id, :permission)`, share)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (user *User) RevokeShare(db *sqlx.DB, share_id int) error {
+	res, err := db.Exec("delete from shares where id=? and owner_id=?", share_id, user.Id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("share with id %d not found", share_id)
+	}
+
+	return nil
+}
+
+// GetShares returns everything the user has shared with others.
+func (user *User) GetShares(db *sqlx.DB) ([]Share, error) {
+	shares := make([]Share, 0)
+	err := db.Select(&shares, `select s.*, u.user_name from shares s
+		join users u on u.id=s.user_id where s.owner_id=? order by s.id`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]Note, 0, len(shares))
+	for i := range shares {
+		switch {
+		case shares[i].NoteId != nil:
+			var note Note
+			if err = db.Get(&note, "select * from notes where id=?", *shares[i].NoteId); err != nil {
+				return nil, err
+			}
+
+			if shares[i].NoteTitle, err = atRest.OpenText(db, note.UserId, note.Title); err != nil {
+				return nil, err
+			}
+		case shares[i].NotebookId != nil:
+			notes = append(notes, Note{UserId: user.Id, NotebookId: shares[i].NotebookId})
+		}
+	}
+
+	// notebook paths are resolved the same way as for notes
+	if err = LoadNotebookPaths(db, notes); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, 0; i < len(shares); i++ {
+		if shares[i].NoteId == nil && shares[i].NotebookId != nil {
+			shares[i].Notebook = notes[j].Notebook
+			j++
+		}
+	}
+
+	return shares, nil
+}
+
+// GetSharedWithMe returns notes of other users shared with the user either
+// directly or through a notebook.
+func (user *User) GetSharedWithMe(db *sqlx.DB) ([]SharedNote, error) {
+	shared := make([]SharedNote, 0)
+	err := db.Select(&shared, `with recursive shared_notebooks(id) as (
+			select notebook_id from shares where user_id=$1 and notebook_id is not null
+			union
+			select nb.id from notebooks nb join shared_notebooks sn on nb.parent_id=sn.id
+		)
+		select n.*, u.user_name as owner from notes n join users u on u.id=n.user_id
+		where n.deleted_at is null and n.user_id<>$1 and (
+			n.id in (select note_id from shares where user_id=$1 and note_id is not null) or
+			n.notebook_id in (select id from shared_notebooks))
+		order by u.user_name, n.title`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	notes := make([]Note, len(shared))
+	for i := range shared {
+		perm, err := user.NotePermission(db, &shared[i].Note)
+		if err != nil {
+			return nil, err
+		}
+
+		shared[i].Permission = perm.String()
+		notes[i] = shared[i].Note
+	}
+
+	if err = user.LoadNoteDetails(db, notes); err != nil {
+		return nil, err
+	}
+
+	for i := range shared {
+		shared[i].Note = notes[i]
+	}
+
+	if EncryptedAtRest() {
+		sort.SliceStable(shared, func(i, j int) bool {
+			if shared[i].Owner != shared[j].Owner {
+				return shared[i].Owner < shared[j].Owner
+			}
+			return shared[i].Title < shared[j].Title
+		})
+	}
+
+	return shared, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// openTestDB creates a database in a temporary directory with users of the
+// given names.
+func openTestDB(t *testing.T, user_names ...string) (*sqlx.DB, map[string]*User) {
+	db, err := CreateConn("sqlite3", filepath.Join(t.TempDir(), "notes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	users := make(map[string]*User)
+	for _, name := range user_names {
+		user := &User{UserName: name, Password: "password1"}
+		if err = user.CreateUser(db); err != nil {
+			t.Fatal(err)
+		}
+		users[name] = user
+	}
+
+	return db, users
+}
+
+func TestShareWorkspaceNotebook(t *testing.T) {
+	db, users := openTestDB(t, "alice", "bob", "carol", "dave")
+	alice, bob, carol, dave := users["alice"], users["bob"], users["carol"], users["dave"]
+
+	if err := alice.CreateWorkspace(db, "team"); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, role := range map[string]string{"bob": RoleViewer, "carol": RoleEditor} {
+		if err := alice.SetWorkspaceMember(db, "team", name, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, user := range []*User{alice, bob, carol} {
+		if err := user.SwitchWorkspace(db, "team"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := carol.CreateNotebook(db, "plans"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user  *User
+		perm  string
+		valid bool
+	}{
+		{bob, "write", false},
+		{bob, "read", false},
+		{carol, "write", false},
+		{carol, "read", false},
+		{alice, "write", true},
+	}
+
+	for _, test := range tests {
+		err := test.user.Share(db, 0, "plans", dave.UserName, test.perm)
+		if (err == nil) != test.valid {
+			t.Errorf("%s sharing a workspace notebook with %s permission: error = %v, want valid %v",
+				test.user.UserName, test.perm, err, test.valid)
+		}
+	}
+
+	// personal notebooks can still be shared by their owner
+	if err := bob.SwitchWorkspace(db, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.CreateNotebook(db, "own"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.Share(db, 0, "own", dave.UserName, "write"); err != nil {
+		t.Errorf("sharing a personal notebook failed: %s", err)
+	}
+}
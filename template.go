@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Templates are notes of the template kind with {{name}} placeholders in
+// their titles and queries. {{date}}, {{time}}, {{datetime}} and {{user}}
+// are filled in by the client, every other placeholder is asked for.
+var placeholderRe = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_][A-Za-z0-9_ -]*?)\s*\}\}`)
+
+// TemplateBuiltins returns the values of the placeholders which are not
+// asked for.
+func TemplateBuiltins(user_name string, now time.Time) map[string]string {
+	return map[string]string{
+		"date":     now.Format("2006-01-02"),
+		"time":     now.Format("15:04"),
+		"datetime": now.Format("2006-01-02 15:04"),
+		"user":     user_name,
+	}
+}
+
+// TemplatePlaceholders returns the names of placeholders in texts which
+// are not in known, in the order they first appear. Names differing only
+// in case are the same placeholder.
+func TemplatePlaceholders(known map[string]string, texts ...string) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+
+	for _, text := range texts {
+		for _, match := range placeholderRe.FindAllStringSubmatch(text, -1) {
+			name := match[1]
+			key := strings.ToLower(name)
+			if _, ok := known[key]; ok || seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// FillTemplate replaces placeholders in text with their values, values
+// are keyed by lower case names.
+func FillTemplate(text string, values map[string]string) string {
+	return placeholderRe.ReplaceAllStringFunc(text, func(placeholder string) string {
+		name := placeholderRe.FindStringSubmatch(placeholder)[1]
+		if value, ok := values[strings.ToLower(name)]; ok {
+			return value
+		}
+
+		return placeholder
+	})
+}
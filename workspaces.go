@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Roles of workspace members, owners manage members and own every note of
+// the workspace, editors write notes and own the ones they created,
+// viewers only read.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+type Workspace struct {
+	Id      int
+	Name    string `db:"name" json:"name"`
+	OwnerId int    `db:"owner_id" json:"owner_id"`
+
+	// Role is the role of the user who requested the workspace.
+	Role string `db:"role" json:"role"`
+}
+
+type WorkspaceMember struct {
+	UserName string `db:"user_name" json:"user_name"`
+	Role     string `db:"role" json:"role"`
+}
+
+// IdPtr returns the id to be stored in workspace_id columns, nil stands for
+// the personal notes.
+func (workspace *Workspace) IdPtr() *int {
+	if workspace == nil {
+		return nil
+	}
+
+	id := workspace.Id
+	return &id
+}
+
+func RolePermission(role string) Permission {
+	switch role {
+	case RoleOwner:
+		return PermOwner
+	case RoleEditor:
+		return PermWrite
+	case RoleViewer:
+		return PermRead
+	default:
+		return PermNone
+	}
+}
+
+func CheckRole(role string) error {
+	if RolePermission(role) == PermNone {
+		return fmt.Errorf("unknown role \"%s\", use %s, %s or %s", role, RoleOwner, RoleEditor, RoleViewer)
+	}
+
+	return nil
+}
+
+func (user *User) CreateWorkspace(db *sqlx.DB, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("workspace name is empty")
+	}
+
+	var count int
+	if err := db.Get(&count, "select count(*) from workspaces where name=?", name); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return fmt.Errorf("workspace \"%s\" already exists", name)
+	}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	res, err := tx.Exec("insert into workspaces (name, owner_id) values (?, ?)", name, user.Id)
+	if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("insert into workspace_members (workspace_id, user_id, role) values (?, ?, ?)", id, user.Id, RoleOwner)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetWorkspace returns the workspace with name if the user is its member.
+func (user *User) GetWorkspace(db *sqlx.DB, name string) (*Workspace, error) {
+	workspace := new(Workspace)
+
+	err := db.Get(workspace, `select w.*, m.role from workspaces w
+		join workspace_members m on m.workspace_id=w.id
+		where w.name=? and m.user_id=?`, name, user.Id)
+	if err != nil {
+		return nil, fmt.Errorf("workspace \"%s\" not found", name)
+	}
+
+	return workspace, nil
+}
+
+// GetWorkspaces returns the workspaces the user is a member of.
+func (user *User) GetWorkspaces(db *sqlx.DB) ([]Workspace, error) {
+	workspaces := make([]Workspace, 0)
+
+	err := db.Select(&workspaces, `select w.*, m.role from workspaces w
+		join workspace_members m on m.workspace_id=w.id
+		where m.user_id=? order by w.name`, user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return workspaces, nil
+}
+
+func (user *User) GetWorkspaceMembers(db *sqlx.DB, name string) ([]WorkspaceMember, error) {
+	workspace, err := user.GetWorkspace(db, name)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]WorkspaceMember, 0)
+	err = db.Select(&members, `select u.user_name, m.role from workspace_members m
+		join users u on u.id=m.user_id where m.workspace_id=? order by u.user_name`, workspace.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// SetWorkspaceMember adds user_name to the workspace or changes their
+// role, only owners of the workspace may do it.
+func (user *User) SetWorkspaceMember(db *sqlx.DB, name, user_name, role string) error {
+	if err := CheckRole(role); err != nil {
+		return err
+	}
+
+	workspace, err := user.GetWorkspace(db, name)
+	if err != nil {
+		return err
+	}
+
+	if workspace.Role != RoleOwner {
+		return fmt.Errorf("only owners can manage members of workspace \"%s\"", name)
+	}
+
+	member, err := GetUser(db, user_name)
+	if err != nil {
+		return fmt.Errorf("user \"%s\" not found", user_name)
+	}
+
+	if member.Id == workspace.OwnerId {
+		return fmt.Errorf("role of the creator of workspace \"%s\" can't be changed", name)
+	}
+
+	_, err = db.Exec("insert or replace into workspace_members (workspace_id, user_id, role) values (?, ?, ?)",
+		workspace.Id, member.Id, role)
+	return err
+}
+
+// RemoveWorkspaceMember removes user_name from the workspace, owners may
+// remove anyone but the creator, other members only themselves.
+func (user *User) RemoveWorkspaceMember(db *sqlx.DB, name, user_name string) error {
+	workspace, err := user.GetWorkspace(db, name)
+	if err != nil {
+		return err
+	}
+
+	member, err := GetUser(db, user_name)
+	if err != nil {
+		return fmt.Errorf("user \"%s\" not found", user_name)
+	}
+
+	if workspace.Role != RoleOwner && member.Id != user.Id {
+		return fmt.Errorf("only owners can manage members of workspace \"%s\"", name)
+	}
+
+	if member.Id == workspace.OwnerId {
+		return fmt.Errorf("the creator of workspace \"%s\" can't be removed", name)
+	}
+
+	res, err := db.Exec("delete from workspace_members where workspace_id=? and user_id=?", workspace.Id, member.Id)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return fmt.Errorf("user \"%s\" is not a member of workspace \"%s\"", user_name, name)
+	}
+
+	return nil
+}
+
+// SwitchWorkspace makes the workspace with name the active scope of the
+// session, an empty name switches back to the personal notes.
+func (user *User) SwitchWorkspace(db *sqlx.DB, name string) error {
+	if name == "" {
+		user.Workspace = nil
+		return nil
+	}
+
+	workspace, err := user.GetWorkspace(db, name)
+	if err != nil {
+		return err
+	}
+
+	user.Workspace = workspace
+	return nil
+}